@@ -0,0 +1,195 @@
+// ◄◄◄ gobmp/colorspace.go ►►►
+// Copyright © 2012 Jason Summers
+// Use of this code is governed by an MIT-style license that can
+// be found in the readme.md file.
+//
+// Color space options for the BMP encoder
+//
+
+package gobmp
+
+import "fmt"
+import "math"
+
+// Values of the CSType field.
+const (
+	lCS_CALIBRATED_RGB = 0
+	lCS_sRGB           = 0x73524742 // 'sRGB'
+	pROFILE_LINKED     = 0x4c494e4b // 'LINK'
+	pROFILE_EMBEDDED   = 0x4d424544 // 'MBED'
+)
+
+// An Intent is a rendering intent, as stored in a BITMAPV5HEADER.
+type Intent uint32
+
+// Supported Intent values.
+const (
+	IntentBusiness        Intent = 1 // Saturation
+	IntentGraphics        Intent = 2 // Relative colorimetric
+	IntentImages          Intent = 4 // Perceptual
+	IntentAbsColorimetric Intent = 8 // Absolute colorimetric
+)
+
+// A Chromaticity is a color's CIE 1931 x and y coordinates.
+type Chromaticity struct {
+	X, Y float64
+}
+
+// CalibratedRGB describes an RGB color space by its primaries, white point,
+// and gamma values. See EncoderOptions.SetCalibratedRGB.
+type CalibratedRGB struct {
+	Red, Green, Blue Chromaticity
+	White            Chromaticity
+	Gamma            [3]float64 // Red, green, and blue gamma
+}
+
+// SetCalibratedRGB causes the image to be labeled with the given color space
+// (LCS_CALIBRATED_RGB), instead of sRGB. This requires a BITMAPV4HEADER or
+// BITMAPV5HEADER; a BITMAPV4HEADER will be used unless another header is
+// needed or selected. It replaces any ICC profile set by SetICCProfile or
+// SetLinkedProfile. A nil value (the default) disables it.
+func (opts *EncoderOptions) SetCalibratedRGB(c *CalibratedRGB) {
+	opts.calibrated = c
+	if c != nil {
+		opts.iccProfile = nil
+		opts.linkedProfile = ""
+	}
+}
+
+// SetICCProfile causes the given ICC profile to be embedded in the image.
+// This requires a BITMAPV5HEADER, which will be used unless SetHeaderType
+// selects a different header, in which case an error is returned.
+// A nil profile (the default) means to label the image as sRGB.
+func (opts *EncoderOptions) SetICCProfile(profile []byte) {
+	opts.iccProfile = profile
+	opts.linkedProfile = ""
+	if profile != nil {
+		opts.calibrated = nil
+	}
+}
+
+// SetLinkedProfile causes the image to refer to the ICC profile in the named
+// file, instead of embedding it. The name should be a Windows path, and may
+// only contain characters in the Latin-1 range. Like SetICCProfile, this
+// requires a BITMAPV5HEADER. An empty name (the default) means not to link
+// to a profile.
+func (opts *EncoderOptions) SetLinkedProfile(filename string) {
+	opts.linkedProfile = filename
+	opts.iccProfile = nil
+	if filename != "" {
+		opts.calibrated = nil
+	}
+}
+
+// SetIntent sets the rendering intent to write. It is only written when a
+// BITMAPV5HEADER is used. The default is IntentImages.
+func (opts *EncoderOptions) SetIntent(intent Intent) {
+	opts.intent = intent
+}
+
+// Decide on the color space fields of the header, and prepare the profile
+// data, if any.
+func (e *encoder) setupColorSpace() error {
+	e.csType = lCS_sRGB
+
+	if e.opts.iccProfile != nil {
+		e.csType = pROFILE_EMBEDDED
+		e.profile = e.opts.iccProfile
+	} else if e.opts.linkedProfile != "" {
+		e.csType = pROFILE_LINKED
+		// The filename is stored as a NUL-terminated string.
+		for _, c := range e.opts.linkedProfile {
+			if c == 0 || c > 0xff {
+				return UnsupportedError(fmt.Sprintf("character %q in linked profile name", c))
+			}
+			e.profile = append(e.profile, byte(c))
+		}
+		e.profile = append(e.profile, 0)
+	} else if e.opts.calibrated != nil {
+		e.csType = lCS_CALIBRATED_RGB
+		err := e.setCalibration(e.opts.calibrated)
+		if err != nil {
+			return err
+		}
+		if e.opts.headerType != 0 && e.opts.headerType != HeaderV4 &&
+			e.opts.headerType != HeaderV5 {
+			return UnsupportedError(fmt.Sprintf("calibrated RGB with a %v", e.opts.headerType))
+		}
+	}
+
+	if e.profile != nil && e.opts.headerType != 0 && e.opts.headerType != HeaderV5 {
+		return UnsupportedError(fmt.Sprintf("ICC profile with a %v", e.opts.headerType))
+	}
+	return nil
+}
+
+// Convert a number to an unsigned fixed-point number with the given number of
+// fraction bits.
+func toFixedPoint(v float64, fracBits uint, name string) (uint32, error) {
+	f := math.Floor(v*float64(uint64(1)<<fracBits) + 0.5)
+	if !(f >= 0 && f <= math.MaxUint32) {
+		return 0, UnsupportedError(fmt.Sprintf("%s %v out of range", name, v))
+	}
+	return uint32(f), nil
+}
+
+// Calculate the CIE XYZ endpoints of the color space's primaries, and record
+// them along with the gamma values in e.endpoints and e.gamma.
+func (e *encoder) setCalibration(c *CalibratedRGB) error {
+	var err error
+	var xyz [3][3]float64 // Column i is the XYZ of primary i with Y=1
+
+	for i, p := range []Chromaticity{c.Red, c.Green, c.Blue} {
+		if p.Y <= 0 {
+			return UnsupportedError(fmt.Sprintf("primary chromaticity %v", p))
+		}
+		xyz[0][i] = p.X / p.Y
+		xyz[1][i] = 1
+		xyz[2][i] = (1 - p.X - p.Y) / p.Y
+	}
+	if c.White.Y <= 0 {
+		return UnsupportedError(fmt.Sprintf("white point chromaticity %v", c.White))
+	}
+	white := [3]float64{c.White.X / c.White.Y, 1, (1 - c.White.X - c.White.Y) / c.White.Y}
+
+	// Scale the primaries so that they add up to the white point, by solving
+	// xyz * s = white (using Cramer's rule).
+	det := func(m [3][3]float64) float64 {
+		return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+			m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+			m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	}
+	d := det(xyz)
+	if d == 0 {
+		return UnsupportedError("primaries are not independent")
+	}
+	for i := 0; i < 3; i++ {
+		mi := xyz
+		for k := 0; k < 3; k++ {
+			mi[k][i] = white[k]
+		}
+		s := det(mi) / d
+		for k := 0; k < 3; k++ {
+			e.endpoints[3*i+k], err = toFixedPoint(s*xyz[k][i], 30, "endpoint")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for k := 0; k < 3; k++ {
+		e.gamma[k], err = toFixedPoint(c.Gamma[k], 16, "gamma")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) writeProfile() error {
+	if e.profile == nil {
+		return nil
+	}
+	_, err := e.w.Write(e.profile)
+	return err
+}
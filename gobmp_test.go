@@ -5,13 +5,16 @@
 package gobmp
 
 import "testing"
+import "context"
 import "image"
 import "image/color"
+import "image/draw"
 import "image/png"
 import "os"
 import "io/ioutil"
 import "bytes"
 import "fmt"
+import "strings"
 
 func readImageFromFile(t *testing.T, srcFilename string) image.Image {
 	var err error
@@ -229,3 +232,1515 @@ func TestDecode(t *testing.T) {
 		compareFiles(t, expectedFN, dstFN)
 	}
 }
+
+func TestDecodePaletteAlpha(t *testing.T) {
+	var buf bytes.Buffer
+
+	pal := color.Palette{color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	m := image.NewPaletted(image.Rect(0, 0, 4, 2), pal)
+	m.Pix[1] = 1
+	err := Encode(&buf, m)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	b := buf.Bytes()
+
+	// With all alpha bytes 0, the palette should be opaque.
+	opts := new(DecoderOptions)
+	opts.ReadPaletteAlpha(true)
+	m2, err := DecodeWithOptions(bytes.NewReader(b), opts)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if _, _, _, a := m2.At(0, 0).RGBA(); a != 0xffff {
+		t.Errorf("expected opaque pixel, got alpha %d\n", a)
+	}
+
+	// Make palette entry 1 half-transparent.
+	b[54+4+3] = 128
+	m2, err = DecodeWithOptions(bytes.NewReader(b), opts)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if c := m2.At(1, 0); c != (color.NRGBA{0, 0, 255, 128}) {
+		t.Errorf("expected {0 0 255 128}, got %v\n", c)
+	}
+
+	// Without the option, the alpha byte should be ignored.
+	m2, err = Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if _, _, _, a := m2.At(1, 0).RGBA(); a != 0xffff {
+		t.Errorf("expected opaque pixel, got alpha %d\n", a)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	fn := fmt.Sprintf("testdata%csrcimg%c%s", os.PathSeparator, os.PathSeparator, "rgb16-565pal.bmp")
+	file, err := os.Open(fn)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	defer file.Close()
+
+	info, err := Inspect(file)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if info.HeaderType.String() != "BITMAPINFOHEADER" || info.Compression.String() != "BI_BITFIELDS" {
+		t.Errorf("wrong header type or compression: %v %v\n", info.HeaderType, info.Compression)
+	}
+	if info.Width != 31 || info.Height != 32 || info.BitCount != 16 || info.OffBits != 1090 {
+		t.Errorf("wrong header fields: %+v\n", *info)
+	}
+	if info.RedMask != 0xf800 || info.GreenMask != 0x07e0 || info.BlueMask != 0x001f ||
+		info.BitFieldsSize != 12 {
+		t.Errorf("wrong bitfields: %+v\n", *info)
+	}
+	if info.ClrUsed != 256 || info.PaletteEntries != 0 || info.GapSize != 1024 {
+		t.Errorf("wrong palette or gap size: %+v\n", *info)
+	}
+}
+
+// Add every BMP file in testdata/srcimg to the fuzzing corpus.
+func addFuzzSeeds(f *testing.F) {
+	dir := fmt.Sprintf("testdata%csrcimg", os.PathSeparator)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		f.Fatalf("%s\n", err.Error())
+	}
+	for _, fi := range entries {
+		if !strings.HasSuffix(fi.Name(), ".bmp") {
+			continue
+		}
+		b, err := ioutil.ReadFile(dir + string(os.PathSeparator) + fi.Name())
+		if err != nil {
+			f.Fatalf("%s\n", err.Error())
+		}
+		f.Add(b)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		cfg, err := DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		if cfg.Width*cfg.Height > 1000000 {
+			return
+		}
+		m, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		if m.Bounds().Dx() != cfg.Width || m.Bounds().Dy() != cfg.Height {
+			t.Errorf("Decode and DecodeConfig disagree about image size")
+		}
+	})
+}
+
+func FuzzDecodeConfig(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodeConfig(bytes.NewReader(b))
+		Inspect(bytes.NewReader(b))
+	})
+}
+
+// FuzzDecodeRLE feeds arbitrary data to the RLE decoder, bypassing the
+// headers.
+func FuzzDecodeRLE(f *testing.F) {
+	for _, fn := range []string{"pal8rle.bmp", "pal4rle.bmp"} {
+		b, err := ioutil.ReadFile(fmt.Sprintf("testdata%csrcimg%c%s", os.PathSeparator, os.PathSeparator, fn))
+		if err != nil {
+			f.Fatalf("%s\n", err.Error())
+		}
+		f.Add(b[getDWORD(b[10:14]):], fn == "pal4rle.bmp", uint8(31), uint8(32), false)
+	}
+	f.Fuzz(func(t *testing.T, b []byte, rle4 bool, w, h uint8, topDown bool) {
+		if w == 0 || h == 0 {
+			return
+		}
+		d := new(decoder)
+		d.r = bytes.NewReader(b)
+		d.opts = new(DecoderOptions)
+		d.ctx = context.Background()
+		d.width = int(w)
+		d.height = int(h)
+		d.isTopDown = topDown
+		if rle4 {
+			d.biCompression = bI_RLE4
+			d.bitCount = 4
+		} else {
+			d.biCompression = bI_RLE8
+			d.bitCount = 8
+		}
+		d.dstPalNumEntries = 200
+		d.dstPalette = make(color.Palette, d.dstPalNumEntries)
+		for i := range d.dstPalette {
+			d.dstPalette[i] = color.Gray{uint8(i)}
+		}
+		d.img_Paletted = image.NewPaletted(image.Rect(0, 0, d.width, d.height), d.dstPalette)
+		d.readBitsRLE()
+		for _, v := range d.img_Paletted.Pix {
+			if int(v) >= d.dstPalNumEntries {
+				t.Fatalf("invalid palette index %d\n", v)
+			}
+		}
+	})
+}
+
+// Make a BMP file containing the given RLE-compressed image data, with a
+// 16-color palette.
+func makeRLEFile(compression uint32, w, h int, bits []byte) []byte {
+	f := make([]byte, 14+40+16*4)
+	f[0], f[1] = 'B', 'M'
+	setDWORD(f[2:6], uint32(len(f)+len(bits)))
+	setDWORD(f[10:14], uint32(len(f)))
+	setDWORD(f[14:18], 40)
+	setDWORD(f[18:22], uint32(w))
+	setDWORD(f[22:26], uint32(h))
+	f[26] = 1
+	if compression == bI_RLE4 {
+		f[28] = 4
+	} else {
+		f[28] = 8
+	}
+	setDWORD(f[30:34], compression)
+	setDWORD(f[34:38], uint32(len(bits)))
+	setDWORD(f[46:50], 16)
+	for i := 0; i < 16; i++ {
+		f[54+4*i] = uint8(i * 16)
+	}
+	return append(f, bits...)
+}
+
+func TestDecodeRLE(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression uint32
+		w, h        int
+		bits        []byte
+		pix         []uint8 // Expected pixels, top row first
+	}{
+		{"runs", bI_RLE8, 4, 3,
+			[]byte{2, 5, 0, 3, 7, 8, 9, 0, 0, 0, 4, 1, 0, 0, 4, 2, 0, 1},
+			[]uint8{2, 2, 2, 2, 1, 1, 1, 1, 5, 5, 7, 8}},
+		{"run past end of row", bI_RLE8, 4, 2,
+			[]byte{9, 3, 0, 0, 2, 4, 0, 1},
+			[]uint8{4, 4, 0, 0, 3, 3, 3, 3}},
+		{"delta", bI_RLE8, 4, 3,
+			[]byte{1, 3, 0, 2, 1, 1, 2, 4, 0, 1},
+			[]uint8{0, 0, 0, 0, 0, 0, 4, 4, 3, 0, 0, 0}},
+		{"delta past end of row", bI_RLE8, 4, 3,
+			[]byte{1, 3, 0, 2, 5, 0, 1, 6, 0, 0, 1, 7, 0, 1},
+			[]uint8{0, 0, 0, 0, 7, 0, 0, 0, 3, 0, 0, 0}},
+		{"delta past end of image", bI_RLE8, 4, 3,
+			[]byte{1, 3, 0, 0, 1, 7, 0, 2, 0, 9, 1, 8, 0, 1},
+			[]uint8{0, 0, 0, 0, 7, 0, 0, 0, 3, 0, 0, 0}},
+		{"data after end of bitmap", bI_RLE8, 4, 2,
+			[]byte{4, 1, 0, 1, 4, 2},
+			[]uint8{0, 0, 0, 0, 1, 1, 1, 1}},
+		{"no end of bitmap", bI_RLE8, 4, 2,
+			[]byte{4, 1, 0, 0, 2, 2},
+			[]uint8{2, 2, 0, 0, 1, 1, 1, 1}},
+		{"truncated absolute run", bI_RLE8, 4, 3,
+			[]byte{4, 1, 0, 0, 0, 5, 10, 11, 12},
+			[]uint8{0, 0, 0, 0, 10, 11, 0, 0, 1, 1, 1, 1}},
+		{"RLE4 runs", bI_RLE4, 5, 2,
+			[]byte{5, 0x12, 0, 0, 0, 3, 0x34, 0x50, 0, 1},
+			[]uint8{3, 4, 5, 0, 0, 1, 2, 1, 2, 1}},
+		{"RLE4 delta", bI_RLE4, 5, 2,
+			[]byte{0, 2, 2, 0, 3, 0x77, 0, 0, 0, 2, 3, 0, 2, 0x99, 0, 1},
+			[]uint8{0, 0, 0, 9, 9, 0, 0, 7, 7, 7}},
+		{"RLE4 truncated absolute run", bI_RLE4, 5, 2,
+			[]byte{7, 0x12, 0, 0, 0, 6, 0x34, 0x56, 0x78},
+			[]uint8{3, 4, 5, 6, 0, 1, 2, 1, 2, 1}},
+	}
+
+	for _, tt := range tests {
+		m, err := Decode(bytes.NewReader(makeRLEFile(tt.compression, tt.w, tt.h, tt.bits)))
+		if err != nil {
+			t.Fatalf("%s: %s\n", tt.name, err.Error())
+		}
+		if !bytes.Equal(m.(*image.Paletted).Pix, tt.pix) {
+			t.Errorf("%s: expected %v, got %v\n", tt.name, tt.pix, m.(*image.Paletted).Pix)
+		}
+	}
+}
+
+func TestBadBitFields(t *testing.T) {
+	fn := fmt.Sprintf("testdata%csrcimg%c%s", os.PathSeparator, os.PathSeparator, "rgb16-565pal.bmp")
+	orig, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	for _, greenMask := range []uint32{0x07e1, 0x0f0f, 0xffffffff} {
+		b := make([]byte, len(orig))
+		copy(b, orig)
+		b[58], b[59], b[60], b[61] = byte(greenMask), byte(greenMask>>8), byte(greenMask>>16), byte(greenMask>>24)
+		_, err = Decode(bytes.NewReader(b))
+		if _, ok := err.(FormatError); !ok {
+			t.Errorf("green mask 0x%08x: expected FormatError, got %v\n", greenMask, err)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	var buf bytes.Buffer
+
+	m := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel after 5 rows.
+	lastRow := 0
+	progress := func(rowsDone, rowsTotal int) {
+		if rowsTotal != 30 || rowsDone != lastRow+1 {
+			t.Errorf("unexpected progress %d/%d\n", rowsDone, rowsTotal)
+		}
+		lastRow = rowsDone
+		if rowsDone == 5 {
+			cancel()
+		}
+	}
+
+	opts := new(EncoderOptions)
+	opts.SetProgressFunc(progress)
+	err := EncodeContext(ctx, &buf, m, opts)
+	if err != context.Canceled || lastRow != 5 {
+		t.Errorf("EncodeContext: expected cancellation after 5 rows, got %v after %d\n", err, lastRow)
+	}
+
+	buf.Reset()
+	err = EncodeWithOptions(&buf, m, nil)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	lastRow = 0
+	dopts := new(DecoderOptions)
+	dopts.SetProgressFunc(progress)
+	_, err = DecodeContext(ctx, bytes.NewReader(buf.Bytes()), dopts)
+	if err != context.Canceled || lastRow != 5 {
+		t.Errorf("DecodeContext: expected cancellation after 5 rows, got %v after %d\n", err, lastRow)
+	}
+
+	// RLE: progress should reach the last row.
+	fn := fmt.Sprintf("testdata%csrcimg%c%s", os.PathSeparator, os.PathSeparator, "pal8rle.bmp")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	lastRow = 0
+	dopts.SetProgressFunc(func(rowsDone, rowsTotal int) {
+		if rowsDone < lastRow || rowsDone > rowsTotal {
+			t.Errorf("unexpected progress %d/%d\n", rowsDone, rowsTotal)
+		}
+		lastRow = rowsDone
+	})
+	_, err = DecodeWithOptions(bytes.NewReader(b), dopts)
+	if err != nil || lastRow != 32 {
+		t.Errorf("RLE decode: got %v, last row %d\n", err, lastRow)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	var buf1, buf2 bytes.Buffer
+
+	m := image.NewNRGBA(image.Rect(0, 0, 123, 77))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i*7 + i/13)
+	}
+
+	opts := new(EncoderOptions)
+	opts.SupportTransparency(true)
+	err := EncodeWithOptions(&buf1, m, opts)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	opts.SetConcurrency(5)
+	err = EncodeWithOptions(&buf2, m, opts)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !bytes.Equal(buf1.Bytes(), buf2.Bytes()) {
+		t.Errorf("parallel encoding gave different results\n")
+	}
+
+	m1, err := Decode(bytes.NewReader(buf1.Bytes()))
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	dopts := new(DecoderOptions)
+	dopts.SetConcurrency(-1)
+	m2, err := DecodeWithOptions(bytes.NewReader(buf1.Bytes()), dopts)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !bytes.Equal(m1.(*image.NRGBA).Pix, m2.(*image.NRGBA).Pix) {
+		t.Errorf("parallel decoding gave different results\n")
+	}
+
+	// 16-bit images use a scratch buffer for each worker.
+	buf1.Reset()
+	buf2.Reset()
+	opts16 := new(EncoderOptions)
+	opts16.Set16Bit(RGB565)
+	opts16.SetDither(DitherOrdered)
+	err = EncodeWithOptions(&buf1, m, opts16)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	opts16.SetConcurrency(5)
+	err = EncodeWithOptions(&buf2, m, opts16)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !bytes.Equal(buf1.Bytes(), buf2.Bytes()) {
+		t.Errorf("parallel 16-bit encoding gave different results\n")
+	}
+
+	// Empty images
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 5), image.Rect(0, 0, 5, 0)} {
+		buf1.Reset()
+		buf2.Reset()
+		opts.SetConcurrency(0)
+		err = EncodeWithOptions(&buf1, image.NewNRGBA(r), opts)
+		if err != nil {
+			t.Fatalf("%v: %s\n", r, err.Error())
+		}
+		opts.SetConcurrency(4)
+		err = EncodeWithOptions(&buf2, image.NewNRGBA(r), opts)
+		if err != nil {
+			t.Fatalf("%v: %s\n", r, err.Error())
+		}
+		if !bytes.Equal(buf1.Bytes(), buf2.Bytes()) {
+			t.Errorf("%v: parallel encoding gave different results\n", r)
+		}
+	}
+}
+
+// BenchmarkDecode decodes each of the BMP files in testdata/srcimg.
+func BenchmarkDecode(b *testing.B) {
+	for i := range decodeTests {
+		fn := decodeTests[i].srcFN
+		src, err := ioutil.ReadFile(fmt.Sprintf("testdata%csrcimg%c%s", os.PathSeparator, os.PathSeparator, fn))
+		if err != nil {
+			b.Fatalf("%s\n", err.Error())
+		}
+		b.Run(strings.TrimSuffix(fn, ".bmp"), func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			for n := 0; n < b.N; n++ {
+				_, err := Decode(bytes.NewReader(src))
+				if err != nil {
+					b.Fatalf("%s\n", err.Error())
+				}
+			}
+		})
+	}
+}
+
+// Encode subimages of various types, and make sure they decode correctly.
+func TestEncodeSubImage(t *testing.T) {
+	r := image.Rect(0, 0, 20, 10)
+	sub := image.Rect(3, 2, 17, 9)
+	pal := color.Palette{color.Black, color.White, color.RGBA{255, 0, 0, 255}}
+
+	imgs := []image.Image{image.NewNRGBA(r), image.NewRGBA(r),
+		image.NewYCbCr(r, image.YCbCrSubsampleRatio420), image.NewGray(r),
+		image.NewPaletted(r, pal)}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := color.RGBA{uint8(x * 12), uint8(y * 25), uint8(x * y), 255}
+			imgs[0].(*image.NRGBA).Set(x, y, c)
+			imgs[1].(*image.RGBA).Set(x, y, c)
+			imgs[3].(*image.Gray).Set(x, y, c)
+			imgs[4].(*image.Paletted).Set(x, y, pal[(x+y)%3])
+		}
+	}
+
+	for _, m := range imgs {
+		var buf bytes.Buffer
+		m = m.(interface {
+			SubImage(image.Rectangle) image.Image
+		}).SubImage(sub)
+		err := Encode(&buf, m)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		m2, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		for y := 0; y < sub.Dy(); y++ {
+			for x := 0; x < sub.Dx(); x++ {
+				r1, g1, b1, _ := m.At(sub.Min.X+x, sub.Min.Y+y).RGBA()
+				r2, g2, b2, _ := m2.At(x, y).RGBA()
+				if r1>>8 != r2>>8 || g1>>8 != g2>>8 || b1>>8 != b2>>8 {
+					t.Fatalf("%T: pixel (%d,%d) differs\n", m, x, y)
+				}
+			}
+		}
+	}
+}
+
+// Paletted images whose palettes have more than 256 entries are written as
+// truecolor images.
+func TestEncodeLargePalette(t *testing.T) {
+	pal := make(color.Palette, 280)
+	for i := range pal {
+		pal[i] = color.NRGBA{uint8(i), 0, 0, 255}
+	}
+	pal[270] = color.NRGBA{0, 0, 0, 0} // Unused
+
+	for _, trns := range []bool{false, true} {
+		m := image.NewPaletted(image.Rect(0, 0, 7, 3), pal)
+		for i := range m.Pix {
+			m.Pix[i] = uint8(i * 11)
+		}
+		expected := 24
+		if trns {
+			m.Palette = append(color.Palette{}, pal...)
+			m.Palette[m.Pix[1]] = color.NRGBA{1, 2, 3, 0x80}
+			expected = 32
+		}
+
+		var buf bytes.Buffer
+		opts := new(EncoderOptions)
+		opts.SupportTransparency(true)
+		err := EncodeWithOptions(&buf, m, opts)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		info, err := Inspect(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if info.BitCount != expected {
+			t.Fatalf("expected %d-bit, got %d-bit\n", expected, info.BitCount)
+		}
+	}
+
+	// An empty image
+	opts := new(EncoderOptions)
+	opts.SupportTransparency(true)
+	err := EncodeWithOptions(ioutil.Discard, image.NewPaletted(image.Rect(0, 0, 7, 0), pal), opts)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+}
+
+// Make a paletted image with a mixture of runs and noise.
+func makeTestPaletted(w, h, nColors int) *image.Paletted {
+	pal := make(color.Palette, nColors)
+	for i := range pal {
+		pal[i] = color.RGBA{uint8(i), uint8(255 - i), uint8(i * 3), 255}
+	}
+	m := image.NewPaletted(image.Rect(0, 0, w, h), pal)
+	seed := uint32(12345)
+	for i := range m.Pix {
+		seed = seed*1103515245 + 12345
+		switch (i / 37) % 4 {
+		case 0: // noise
+			m.Pix[i] = uint8((seed >> 16) % uint32(nColors))
+		case 1: // solid
+			m.Pix[i] = uint8((i / 37) % nColors)
+		case 2: // alternating
+			m.Pix[i] = uint8((i % 2) * (nColors - 1))
+		default: // short runs
+			m.Pix[i] = uint8((i / 3) % nColors)
+		}
+	}
+	return m
+}
+
+func TestEncodeRLE(t *testing.T) {
+	for _, nColors := range []int{2, 16, 256} {
+		m := makeTestPaletted(301, 41, nColors)
+
+		var buf bytes.Buffer
+		opts := new(EncoderOptions)
+		opts.SetRLE(true)
+		err := EncodeWithOptions(&buf, m, opts)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+
+		info, err := Inspect(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		expectedCmpr := CompressionRLE4
+		if nColors > 16 {
+			expectedCmpr = CompressionRLE8
+		}
+		if info.Compression != expectedCmpr {
+			t.Errorf("%d colors: expected %v, got %v\n", nColors, expectedCmpr, info.Compression)
+		}
+		if int(info.FileSize) != buf.Len() || int(info.SizeImage) != buf.Len()-int(info.OffBits) {
+			t.Errorf("%d colors: bad bfSize or biSizeImage\n", nColors)
+		}
+
+		m2, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if !bytes.Equal(m.Pix, m2.(*image.Paletted).Pix) {
+			t.Errorf("%d colors: decoded image differs\n", nColors)
+		}
+	}
+}
+
+func TestEncodeSmallest(t *testing.T) {
+	noise := makeTestPaletted(40, 40, 256)
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(i * 73)
+	}
+	solid := makeTestPaletted(40, 40, 16)
+	for i := range solid.Pix {
+		solid.Pix[i] = 5
+	}
+
+	tests := []struct {
+		m           *image.Paletted
+		compression Compression
+	}{
+		{noise, CompressionRGB},
+		{solid, CompressionRLE4},
+		{makeTestPaletted(301, 41, 256), CompressionRLE8},
+	}
+
+	opts := new(EncoderOptions)
+	opts.SetSmallest(true)
+	for i, tst := range tests {
+		var buf bytes.Buffer
+		err := EncodeWithOptions(&buf, tst.m, opts)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		info, err := Inspect(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if info.Compression != tst.compression {
+			t.Errorf("test %d: expected %v, got %v\n", i, tst.compression, info.Compression)
+		}
+		m2, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if !bytes.Equal(tst.m.Pix, m2.(*image.Paletted).Pix) {
+			t.Errorf("test %d: decoded image differs\n", i)
+		}
+	}
+}
+
+func TestEncodeRLETransparency(t *testing.T) {
+	for _, nColors := range []int{16, 256} {
+		m := makeTestPaletted(300, 20, nColors)
+		trnsIdx := uint8(1)
+		m.Palette[trnsIdx] = color.NRGBA{0, 0, 0, 0}
+		// Make the top rows, and part of the bottom row, transparent.
+		for i := 0; i < 3*m.Stride; i++ {
+			m.Pix[i] = trnsIdx
+		}
+		for i := 19*m.Stride + 100; i < 19*m.Stride+200; i++ {
+			m.Pix[i] = trnsIdx
+		}
+
+		var buf bytes.Buffer
+		opts := new(EncoderOptions)
+		opts.SupportTransparency(true)
+		opts.SetRLETransparency(true)
+		err := EncodeWithOptions(&buf, m, opts)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+
+		m2, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		p2, ok := m2.(*image.Paletted)
+		if !ok {
+			t.Fatalf("%d colors: expected a paletted image\n", nColors)
+		}
+		for i, v := range m.Pix {
+			// Our decoder uses palette entry 0 for skipped pixels.
+			expected := v
+			if v == trnsIdx {
+				expected = 0
+			}
+			if p2.Pix[i] != expected {
+				t.Fatalf("%d colors: pixel %d: expected %d, got %d\n", nColors, i, expected, p2.Pix[i])
+			}
+		}
+	}
+}
+
+// The palette is rebuilt when a bit count is requested, so the transparent
+// entry's index changes.
+func TestEncodeRLETransparencyBitCount(t *testing.T) {
+	m := makeTestPaletted(40, 10, 20)
+	trnsIdx := uint8(1)
+	m.Palette[trnsIdx] = color.NRGBA{0, 0, 0, 0}
+	for i := range m.Pix {
+		m.Pix[i] = uint8((i + 5) % 15)
+	}
+
+	opts := new(EncoderOptions)
+	opts.SupportTransparency(true)
+	opts.SetRLETransparency(true)
+	opts.SetBitCount(4)
+	info, m2 := roundTrip(t, m, opts)
+	if info.BitCount != 4 || info.Compression != CompressionRLE4 {
+		t.Fatalf("got %d-bit %v image\n", info.BitCount, info.Compression)
+	}
+	p2 := m2.(*image.Paletted)
+	for i, v := range m.Pix {
+		if v == trnsIdx {
+			// Our decoder uses palette entry 0 for skipped pixels.
+			if p2.Pix[i] != 0 {
+				t.Fatalf("pixel %d: expected a skipped pixel, got %d\n", i, p2.Pix[i])
+			}
+			continue
+		}
+		c1 := color.RGBAModel.Convert(m.Palette[v])
+		c2 := color.RGBAModel.Convert(p2.Palette[p2.Pix[i]])
+		if c1 != c2 {
+			t.Fatalf("pixel %d: expected %v, got %v\n", i, c1, c2)
+		}
+	}
+}
+
+func TestEncode16(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 37, 9))
+	for j := 0; j < 9; j++ {
+		for i := 0; i < 37; i++ {
+			m.SetNRGBA(i, j, color.NRGBA{uint8(i * 7), uint8(j * 28), uint8(i * j), 255})
+		}
+	}
+
+	for _, f := range []Format16{RGB555, RGB565} {
+		for _, d := range []DitherMode{DitherNone, DitherOrdered, DitherFloydSteinberg} {
+			var buf bytes.Buffer
+			opts := new(EncoderOptions)
+			opts.Set16Bit(f)
+			opts.SetDither(d)
+			err := EncodeWithOptions(&buf, m, opts)
+			if err != nil {
+				t.Fatalf("%s\n", err.Error())
+			}
+
+			info, err := Inspect(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("%s\n", err.Error())
+			}
+			if info.BitCount != 16 || info.HeaderType != HeaderInfo {
+				t.Fatalf("format %d: got %d-bit image with %v\n", f, info.BitCount, info.HeaderType)
+			}
+			if f == RGB565 && (info.Compression != CompressionBitFields || info.GreenMask != 0x07e0) {
+				t.Fatalf("format %d: got %v, green mask 0x%x\n", f, info.Compression, info.GreenMask)
+			}
+
+			m2, err := Decode(&buf)
+			if err != nil {
+				t.Fatalf("%s\n", err.Error())
+			}
+			// Dithering may move a sample to an adjacent level.
+			tolerance := 4
+			if d != DitherNone {
+				tolerance = 8
+			}
+			for j := 0; j < 9; j++ {
+				for i := 0; i < 37; i++ {
+					c1 := m.NRGBAAt(i, j)
+					c2 := color.NRGBAModel.Convert(m2.At(i, j)).(color.NRGBA)
+					for _, p := range [][2]uint8{{c1.R, c2.R}, {c1.G, c2.G}, {c1.B, c2.B}} {
+						diff := int(p[0]) - int(p[1])
+						if diff < -tolerance || diff > tolerance {
+							t.Fatalf("format %d, dither %d: (%d,%d): expected %v, got %v\n", f, d, i, j, c1, c2)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncode16Alpha(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 16, 4))
+	for j := 0; j < 4; j++ {
+		for i := 0; i < 16; i++ {
+			m.SetNRGBA(i, j, color.NRGBA{uint8(i * 17), 0x80, uint8(j * 85), uint8(i * 17)})
+		}
+	}
+
+	tests := []struct {
+		format         Format16
+		alphaBitFields bool
+		headerType     HeaderType
+		compression    Compression
+	}{
+		{ARGB1555, false, HeaderV5, CompressionBitFields},
+		{ARGB4444, false, HeaderV5, CompressionBitFields},
+		{ARGB1555, true, HeaderInfo, CompressionAlphaBitFields},
+		{ARGB4444, true, HeaderInfo, CompressionAlphaBitFields},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		opts := new(EncoderOptions)
+		opts.Set16Bit(tt.format)
+		opts.SetAlphaBitFields(tt.alphaBitFields)
+		opts.SetAlphaThreshold(100)
+		err := EncodeWithOptions(&buf, m, opts)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+
+		info, err := Inspect(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if info.HeaderType != tt.headerType || info.Compression != tt.compression ||
+			info.AlphaMask != format16Masks[tt.format][3] {
+			t.Fatalf("format %d: got %v, %v, alpha mask 0x%x\n", tt.format,
+				info.HeaderType, info.Compression, info.AlphaMask)
+		}
+
+		m2, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		for i := 0; i < 16; i++ {
+			a1 := m.NRGBAAt(i, 0).A
+			a2 := color.NRGBAModel.Convert(m2.At(i, 0)).(color.NRGBA).A
+			var expected uint8
+			if tt.format == ARGB4444 {
+				expected = a1
+			} else if a1 >= 100 {
+				expected = 255
+			}
+			if a2 != expected {
+				t.Fatalf("format %d: pixel %d: expected alpha %d, got %d\n", tt.format, i, expected, a2)
+			}
+		}
+	}
+
+	// With dithering, the average alpha of a flat area should be preserved.
+	m3 := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for i := 0; i < len(m3.Pix); i += 4 {
+		copy(m3.Pix[i:i+4], []uint8{0x20, 0x40, 0x60, 0x40})
+	}
+	for _, d := range []DitherMode{DitherOrdered, DitherFloydSteinberg} {
+		var buf bytes.Buffer
+		opts := new(EncoderOptions)
+		opts.Set16Bit(ARGB1555)
+		opts.SetAlphaDither(d)
+		err := EncodeWithOptions(&buf, m3, opts)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		m4, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		opaque := 0
+		for j := 0; j < 32; j++ {
+			for i := 0; i < 32; i++ {
+				if color.NRGBAModel.Convert(m4.At(i, j)).(color.NRGBA).A == 255 {
+					opaque++
+				}
+			}
+		}
+		// Expect about 1/4 of the pixels to be opaque.
+		if opaque < 200 || opaque > 312 {
+			t.Fatalf("dither %d: %d of 1024 pixels are opaque\n", d, opaque)
+		}
+	}
+}
+
+// Encode m using opts, failing the test on error.
+func encodeForTest(t *testing.T, m image.Image, opts *EncoderOptions) []byte {
+	var buf bytes.Buffer
+	err := EncodeWithOptions(&buf, m, opts)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	return buf.Bytes()
+}
+
+// Read the headers of the BMP file in data, and decode it.
+func inspectAndDecode(t *testing.T, data []byte, dopts *DecoderOptions) (*Info, image.Image) {
+	info, err := Inspect(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if int(info.FileSize) != len(data) {
+		t.Fatalf("bfSize is %d, expected %d\n", info.FileSize, len(data))
+	}
+	m, err := DecodeWithOptions(bytes.NewReader(data), dopts)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	return info, m
+}
+
+// Encode m using opts, and read back the result.
+func roundTrip(t *testing.T, m image.Image, opts *EncoderOptions) (*Info, image.Image) {
+	return inspectAndDecode(t, encodeForTest(t, m, opts), nil)
+}
+
+func closeColors(c1, c2 color.NRGBA, tolerance int) bool {
+	for _, p := range [][2]uint8{{c1.R, c2.R}, {c1.G, c2.G}, {c1.B, c2.B}} {
+		diff := int(p[0]) - int(p[1])
+		if diff < -tolerance || diff > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// Check that m2 has the same pixels as m1, allowing the red, green, and blue
+// samples to differ by up to tolerance. The colors of fully transparent
+// pixels are ignored. m2's bounds may have a different origin.
+func comparePixels(t *testing.T, name string, m1, m2 image.Image, tolerance int) {
+	b1, b2 := m1.Bounds(), m2.Bounds()
+	if b1.Dx() != b2.Dx() || b1.Dy() != b2.Dy() {
+		t.Fatalf("%s: expected size %v, got %v\n", name, b1.Size(), b2.Size())
+	}
+	for j := 0; j < b1.Dy(); j++ {
+		for i := 0; i < b1.Dx(); i++ {
+			c1 := color.NRGBAModel.Convert(m1.At(b1.Min.X+i, b1.Min.Y+j)).(color.NRGBA)
+			c2 := color.NRGBAModel.Convert(m2.At(b2.Min.X+i, b2.Min.Y+j)).(color.NRGBA)
+			if c1.A != c2.A || (c1.A != 0 && !closeColors(c1, c2, tolerance)) {
+				t.Fatalf("%s: (%d,%d): expected %v, got %v\n", name, i, j, c1, c2)
+			}
+		}
+	}
+}
+
+func expectUnsupported(t *testing.T, err error) {
+	if _, ok := err.(UnsupportedError); !ok {
+		t.Fatalf("expected UnsupportedError, got %v\n", err)
+	}
+}
+
+// Make an NRGBA image, in which pixel (x,y) is fn(x,y).
+func makeTestNRGBA(w, h int, fn func(x, y int) color.NRGBA) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			m.SetNRGBA(i, j, fn(i, j))
+		}
+	}
+	return m
+}
+
+func TestEncodeBitCount(t *testing.T) {
+	pm := makeTestPaletted(21, 5, 3)
+	gm := image.NewGray(image.Rect(0, 0, 21, 5))
+	for i := range gm.Pix {
+		gm.Pix[i] = uint8(i % 4 * 60)
+	}
+	rgbm := makeTestNRGBA(21, 5, func(x, y int) color.NRGBA {
+		return color.NRGBA{uint8(x * 12), uint8(y * 50), 7, 255}
+	})
+
+	tests := []struct {
+		m        image.Image
+		bitCount int
+	}{
+		{pm, 2}, {pm, 8}, {pm, 24}, {pm, 32},
+		{gm, 2}, {gm, 4}, {gm, 16}, {gm, 24},
+		{rgbm, 8}, {rgbm, 32},
+	}
+
+	for _, tt := range tests {
+		opts := new(EncoderOptions)
+		opts.SetBitCount(tt.bitCount)
+		info, m2 := roundTrip(t, tt.m, opts)
+		if info.BitCount != tt.bitCount || info.Compression != CompressionRGB {
+			t.Fatalf("%d-bit: got %d-bit %v image\n", tt.bitCount, info.BitCount, info.Compression)
+		}
+		tolerance := 0
+		if tt.bitCount == 16 {
+			tolerance = 4
+		}
+		comparePixels(t, fmt.Sprintf("%d-bit", tt.bitCount), tt.m, m2, tolerance)
+	}
+
+	// rgbm has more than 16 colors.
+	opts := new(EncoderOptions)
+	opts.SetBitCount(4)
+	err := EncodeWithOptions(ioutil.Discard, rgbm, opts)
+	if err == nil || !strings.Contains(err.Error(), "quantization") {
+		t.Fatalf("expected a quantization error, got %v\n", err)
+	}
+
+	opts.SetBitCount(3)
+	expectUnsupported(t, EncodeWithOptions(ioutil.Discard, rgbm, opts))
+}
+
+// A draw.Quantizer that always returns black and white.
+type bwQuantizer struct{}
+
+func (q bwQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	return append(p, color.Gray{0}, color.Gray{255})
+}
+
+func TestEncodeQuantize(t *testing.T) {
+	m := makeTestNRGBA(64, 64, func(x, y int) color.NRGBA {
+		return color.NRGBA{uint8(x * 4), uint8(y * 4), uint8((x + y) * 2), 255}
+	})
+
+	for _, d := range []DitherMode{DitherNone, DitherFloydSteinberg} {
+		opts := new(EncoderOptions)
+		opts.SetQuantization(true)
+		opts.SetDither(d)
+		info, m2 := roundTrip(t, m, opts)
+		if info.BitCount != 8 || info.PaletteEntries != 256 {
+			t.Fatalf("dither %d: expected a 256-color paletted image\n", d)
+		}
+		// The average error should be small.
+		var totalDiff int
+		for j := 0; j < 64; j++ {
+			for i := 0; i < 64; i++ {
+				c1 := m.NRGBAAt(i, j)
+				c2 := color.NRGBAModel.Convert(m2.At(i, j)).(color.NRGBA)
+				for _, p := range [][2]uint8{{c1.R, c2.R}, {c1.G, c2.G}, {c1.B, c2.B}} {
+					diff := int(p[0]) - int(p[1])
+					if diff < 0 {
+						diff = -diff
+					}
+					totalDiff += diff
+				}
+			}
+		}
+		if totalDiff > 64*64*3*6 {
+			t.Fatalf("dither %d: total error %d is too large\n", d, totalDiff)
+		}
+	}
+
+	// Quantization is not done if there are few enough colors.
+	pm := makeTestPaletted(20, 20, 5)
+	m3 := image.NewRGBA(pm.Bounds())
+	draw.Draw(m3, m3.Bounds(), pm, image.Point{}, draw.Src)
+	opts := new(EncoderOptions)
+	opts.SetQuantization(true)
+	info, m4 := roundTrip(t, m3, opts)
+	if info.BitCount != 4 || info.PaletteEntries != 5 {
+		t.Fatalf("got %d-bit image with %d colors\n", info.BitCount, info.PaletteEntries)
+	}
+	comparePixels(t, "5 colors", m3, m4, 0)
+
+	// Custom quantizer and drawer
+	opts.SetBitCount(1)
+	opts.SetQuantizer(bwQuantizer{})
+	opts.SetDrawer(draw.Src)
+	_, m5 := roundTrip(t, m, opts)
+	expected := color.Palette{color.Gray{0}, color.Gray{255}}.Convert(m.At(63, 63))
+	if color.RGBAModel.Convert(m5.At(63, 63)) != color.RGBAModel.Convert(expected) {
+		t.Fatalf("expected %v, got %v\n", expected, m5.At(63, 63))
+	}
+}
+
+func TestEncodeHeaderType(t *testing.T) {
+	m := makeTestNRGBA(7, 3, func(x, y int) color.NRGBA {
+		i := 4 * (y*7 + x)
+		return color.NRGBA{uint8(i), 0x40, 0x80, uint8(i * 3)}
+	})
+
+	tests := []struct {
+		headerType    HeaderType
+		format16      Format16
+		compression   Compression
+		bitFieldsSize int
+	}{
+		{HeaderInfo, 0, CompressionAlphaBitFields, 16},
+		{HeaderV3, 0, CompressionBitFields, 0},
+		{HeaderV4, 0, CompressionBitFields, 0},
+		{HeaderV5, 0, CompressionBitFields, 0},
+		{HeaderInfo, RGB565, CompressionBitFields, 12},
+		{HeaderV2, RGB565, CompressionBitFields, 0},
+		{HeaderV3, ARGB4444, CompressionBitFields, 0},
+		{HeaderV4, RGB555, CompressionRGB, 0},
+	}
+
+	for _, tt := range tests {
+		opts := new(EncoderOptions)
+		opts.SupportTransparency(true)
+		opts.SetHeaderType(tt.headerType)
+		opts.Set16Bit(tt.format16)
+		info, m2 := roundTrip(t, m, opts)
+		if info.HeaderType != tt.headerType || info.Compression != tt.compression ||
+			info.BitFieldsSize != tt.bitFieldsSize {
+			t.Fatalf("%v: got %v, %v, bitfields size %d\n", tt.headerType, info.HeaderType,
+				info.Compression, info.BitFieldsSize)
+		}
+		if tt.format16 == 0 {
+			comparePixels(t, tt.headerType.String(), m, m2, 0)
+		}
+	}
+
+	// A V2 header has no alpha mask.
+	opts := new(EncoderOptions)
+	opts.SupportTransparency(true)
+	opts.SetHeaderType(HeaderV2)
+	expectUnsupported(t, EncodeWithOptions(ioutil.Discard, m, opts))
+}
+
+func TestEncodeCoreHeader(t *testing.T) {
+	pm := makeTestPaletted(30, 10, 5)
+	rgbm := image.NewRGBA(image.Rect(0, 0, 30, 10))
+	draw.Draw(rgbm, rgbm.Bounds(), pm, image.Point{}, draw.Src)
+
+	for _, m := range []image.Image{pm, rgbm} {
+		opts := new(EncoderOptions)
+		opts.SetHeaderType(HeaderCore)
+		opts.SetSmallest(true)
+		info, m2 := roundTrip(t, m, opts)
+		if info.HeaderType != HeaderCore || info.Compression != CompressionRGB {
+			t.Fatalf("got %v, %v\n", info.HeaderType, info.Compression)
+		}
+		if m == pm && (info.PaletteEntries != 16 || info.PaletteEntrySize != 3 || info.GapSize != 0) {
+			t.Fatalf("got %d palette entries of size %d, gap %d\n", info.PaletteEntries,
+				info.PaletteEntrySize, info.GapSize)
+		}
+		comparePixels(t, fmt.Sprintf("%T", m), m, m2, 0)
+	}
+
+	// SetRLE is ignored in "smallest" mode.
+	opts := new(EncoderOptions)
+	opts.SetHeaderType(HeaderCore)
+	opts.SetSmallest(true)
+	opts.SetRLE(true)
+	info, _ := roundTrip(t, pm, opts)
+	if info.HeaderType != HeaderCore || info.Compression != CompressionRGB {
+		t.Fatalf("smallest+RLE: got %v, %v\n", info.HeaderType, info.Compression)
+	}
+
+	// Unsupported cases
+	opts = new(EncoderOptions)
+	opts.SetHeaderType(HeaderCore)
+	expectUnsupported(t, EncodeWithOptions(ioutil.Discard, image.NewGray(image.Rect(0, 0, 65536, 1)), opts))
+	opts.Set16Bit(RGB565)
+	expectUnsupported(t, EncodeWithOptions(ioutil.Discard, rgbm, opts))
+}
+
+func TestEncodeTopDown(t *testing.T) {
+	pm := makeTestPaletted(40, 9, 16)
+	m := image.NewNRGBA(image.Rect(0, 0, 40, 9))
+	draw.Draw(m, m.Bounds(), pm, image.Point{}, draw.Src)
+
+	for _, src := range []image.Image{pm, m} {
+		for _, concurrency := range []int{0, 4} {
+			opts := new(EncoderOptions)
+			opts.SetTopDown(true)
+			opts.SetSmallest(true)
+			opts.SetConcurrency(concurrency)
+			data := encodeForTest(t, src, opts)
+			info, m2 := inspectAndDecode(t, data, nil)
+			if !info.TopDown || info.Compression != CompressionRGB {
+				t.Fatalf("expected an uncompressed top-down image, got %v, %v\n", info.TopDown, info.Compression)
+			}
+			// The first row in the file is the top row.
+			if src == pm && data[info.OffBits] != pm.Pix[0]<<4|pm.Pix[1] {
+				t.Fatalf("first row is not the top row\n")
+			}
+			comparePixels(t, fmt.Sprintf("%T", src), src, m2, 0)
+		}
+	}
+
+	opts := new(EncoderOptions)
+	opts.SetTopDown(true)
+	opts.SetRLE(true)
+	expectUnsupported(t, EncodeWithOptions(ioutil.Discard, pm, opts))
+
+	// SetRLE is ignored in "smallest" mode.
+	opts.SetSmallest(true)
+	info, _ := roundTrip(t, pm, opts)
+	if !info.TopDown || info.Compression != CompressionRGB {
+		t.Fatalf("smallest+RLE: got %v, %v\n", info.TopDown, info.Compression)
+	}
+}
+
+func TestEncodeICCProfile(t *testing.T) {
+	m := makeTestPaletted(10, 10, 200)
+	profile := []byte("not really an ICC profile")
+
+	opts := new(EncoderOptions)
+	opts.SetICCProfile(profile)
+	opts.SetIntent(IntentGraphics)
+	opts.SetRLE(true)
+	data := encodeForTest(t, m, opts)
+	info, m2 := inspectAndDecode(t, data, nil)
+	if info.HeaderType != HeaderV5 || info.CSType != 0x4d424544 || info.Intent != uint32(IntentGraphics) {
+		t.Fatalf("got %v, CSType 0x%x, intent %d\n", info.HeaderType, info.CSType, info.Intent)
+	}
+	start := 14 + int(info.ProfileData)
+	if int(info.ProfileSize) != len(profile) || start+len(profile) != len(data) ||
+		!bytes.Equal(data[start:], profile) {
+		t.Fatalf("profile not found at offset %d, size %d\n", info.ProfileData, info.ProfileSize)
+	}
+	if !bytes.Equal(m2.(*image.Paletted).Pix, m.Pix) {
+		t.Fatalf("pixels differ\n")
+	}
+
+	opts = new(EncoderOptions)
+	opts.SetLinkedProfile(`C:\profiles\AdobeRGB1998.icc`)
+	data = encodeForTest(t, m, opts)
+	info, _ = inspectAndDecode(t, data, nil)
+	if info.CSType != 0x4c494e4b || info.Intent != uint32(IntentImages) ||
+		string(data[14+info.ProfileData:]) != "C:\\profiles\\AdobeRGB1998.icc\x00" {
+		t.Fatalf("linked profile not written correctly\n")
+	}
+
+	opts.SetHeaderType(HeaderV4)
+	expectUnsupported(t, EncodeWithOptions(ioutil.Discard, m, opts))
+}
+
+func TestEncodeCalibratedRGB(t *testing.T) {
+	// The sRGB primaries and D65 white point
+	c := &CalibratedRGB{
+		Red:   Chromaticity{0.64, 0.33},
+		Green: Chromaticity{0.30, 0.60},
+		Blue:  Chromaticity{0.15, 0.06},
+		White: Chromaticity{0.3127, 0.3290},
+		Gamma: [3]float64{2.2, 2.2, 2.2},
+	}
+	expected := [9]float64{
+		0.4124, 0.2126, 0.0193,
+		0.3576, 0.7152, 0.1192,
+		0.1805, 0.0722, 0.9505,
+	}
+
+	m := image.NewGray(image.Rect(0, 0, 3, 3))
+	opts := new(EncoderOptions)
+	opts.SetCalibratedRGB(c)
+	info, _ := roundTrip(t, m, opts)
+	if info.HeaderType != HeaderV4 || info.CSType != 0 {
+		t.Fatalf("got %v, CSType 0x%x\n", info.HeaderType, info.CSType)
+	}
+	for k := 0; k < 9; k++ {
+		v := float64(info.Endpoints[k]) / (1 << 30)
+		if v < expected[k]-0.0005 || v > expected[k]+0.0005 {
+			t.Fatalf("endpoint %d: expected %v, got %v\n", k, expected[k], v)
+		}
+	}
+	for k := 0; k < 3; k++ {
+		if info.Gamma[k] != 0x23333 {
+			t.Fatalf("gamma %d: expected 0x23333, got 0x%x\n", k, info.Gamma[k])
+		}
+	}
+
+	opts.SetHeaderType(HeaderV3)
+	expectUnsupported(t, EncodeWithOptions(ioutil.Discard, m, opts))
+}
+
+func TestEncode2Bit(t *testing.T) {
+	for nColors := 1; nColors <= 5; nColors++ {
+		m := makeTestPaletted(13, 3, nColors)
+		opts := new(EncoderOptions)
+		opts.Support2Bit(true)
+		info, m2 := roundTrip(t, m, opts)
+		expected := 2
+		if nColors <= 2 {
+			expected = 1
+		} else if nColors > 4 {
+			expected = 4
+		}
+		if info.BitCount != expected {
+			t.Fatalf("%d colors: expected %d-bit, got %d-bit\n", nColors, expected, info.BitCount)
+		}
+		if !bytes.Equal(m2.(*image.Paletted).Pix, m.Pix) {
+			t.Fatalf("%d colors: pixels differ\n", nColors)
+		}
+	}
+}
+
+// Convert an image stored in an ICO or CUR file to a BMP file, and decode it.
+func decodeIconDIB(t *testing.T, d []byte) (image.Image, []byte) {
+	dib := make([]byte, len(d))
+	copy(dib, d)
+	height := int32(getDWORD(dib[8:12])) / 2
+	setDWORD(dib[8:12], uint32(height))
+	info := make([]byte, 14)
+	info[0], info[1] = 'B', 'M'
+	nColors := int(getDWORD(dib[32:36]))
+	if nColors == 0 && getWORD(dib[14:16]) <= 8 {
+		nColors = 1 << getWORD(dib[14:16])
+	}
+	setDWORD(info[10:14], uint32(14+40+4*nColors))
+	if getWORD(dib[14:16]) == 32 {
+		// Tell the decoder to use the alpha channel.
+		setDWORD(dib[16:20], 6) // BI_ALPHABITFIELDS
+		masks := []byte{0, 0, 0xff, 0, 0, 0xff, 0, 0, 0xff, 0, 0, 0, 0, 0, 0, 0xff}
+		dib = append(dib[:40], append(masks, dib[40:]...)...)
+		setDWORD(info[10:14], 14+40+16)
+	}
+	m, err := Decode(bytes.NewReader(append(info, dib...)))
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	// Return the AND mask, too.
+	width := m.Bounds().Dx()
+	maskSize := int(height) * ((width + 31) / 32) * 4
+	return m, d[len(d)-maskSize:]
+}
+
+func TestEncodeIcon(t *testing.T) {
+	pm := makeTestPaletted(16, 16, 16)
+	rgbam := makeTestNRGBA(32, 32, func(x, y int) color.NRGBA {
+		return color.NRGBA{uint8(x * 8), uint8(y * 8), 0x80, uint8(x * y)}
+	})
+	// A palette too large to write is written as a truecolor image.
+	bigPal := makeTestPaletted(16, 16, 256)
+	bigPal.Palette = append(bigPal.Palette, make(color.Palette, 44)...)
+	for i := 256; i < len(bigPal.Palette); i++ {
+		bigPal.Palette[i] = color.NRGBA{0, 0, 0, 0}
+	}
+
+	images := []IconImage{
+		{Image: pm, Hotspot: image.Point{3, 4}},
+		{Image: rgbam, Hotspot: image.Point{5, 6}},
+		{Image: rgbam, PNG: true},
+		{Image: makeTestPaletted(8, 8, 5)},
+		{Image: bigPal},
+	}
+
+	for _, fileType := range []int{1, 2} {
+		var buf bytes.Buffer
+		var err error
+		if fileType == 1 {
+			err = EncodeIcon(&buf, images)
+		} else {
+			err = EncodeCursor(&buf, images)
+		}
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+
+		f := buf.Bytes()
+		if getWORD(f[0:2]) != 0 || int(getWORD(f[2:4])) != fileType || int(getWORD(f[4:6])) != len(images) {
+			t.Fatalf("bad ICONDIR\n")
+		}
+		for n, img := range images {
+			entry := f[6+16*n : 6+16*(n+1)]
+			size := img.Image.Bounds().Dx()
+			if int(entry[0]) != size || int(entry[1]) != size {
+				t.Fatalf("image %d: bad dimensions %dx%d\n", n, entry[0], entry[1])
+			}
+			nColors := 0
+			if p, ok := img.Image.(*image.Paletted); ok && len(p.Palette) <= 16 {
+				nColors = len(p.Palette)
+			}
+			if int(entry[2]) != nColors {
+				t.Fatalf("image %d: expected %d colors, got %d\n", n, nColors, entry[2])
+			}
+			if fileType == 2 && (int(getWORD(entry[4:6])) != img.Hotspot.X ||
+				int(getWORD(entry[6:8])) != img.Hotspot.Y) {
+				t.Fatalf("image %d: bad hotspot\n", n)
+			}
+			offset := getDWORD(entry[12:16])
+			d := f[offset : offset+getDWORD(entry[8:12])]
+
+			var m2 image.Image
+			var mask []byte
+			if img.PNG {
+				m2, err = png.Decode(bytes.NewReader(d))
+				if err != nil {
+					t.Fatalf("%s\n", err.Error())
+				}
+			} else {
+				m2, mask = decodeIconDIB(t, d)
+			}
+
+			// Colors of partially transparent pixels may be slightly off.
+			comparePixels(t, fmt.Sprintf("image %d", n), img.Image, m2, 2)
+
+			if mask != nil {
+				// The mask is stored bottom-up.
+				maskStride := ((size + 31) / 32) * 4
+				for j := 0; j < size; j++ {
+					for i := 0; i < size; i++ {
+						_, _, _, a := img.Image.At(i, j).RGBA()
+						bit := mask[(size-j-1)*maskStride+i/8]&(1<<uint(7-i%8)) != 0
+						if bit != (a == 0) {
+							t.Fatalf("image %d: (%d,%d): bad mask bit\n", n, i, j)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	expectUnsupported(t, EncodeCursor(ioutil.Discard, []IconImage{{Image: pm, Hotspot: image.Point{16, 0}}}))
+	expectUnsupported(t, EncodeIcon(ioutil.Discard, []IconImage{{Image: image.NewGray(image.Rect(0, 0, 257, 1))}}))
+}
+
+func TestEncodeAutoPalette(t *testing.T) {
+	tests := []struct {
+		nColors        int
+		gray           bool
+		bitCount       int
+		paletteEntries int
+	}{
+		{2, false, 1, 2},
+		{10, false, 4, 10},
+		{40, false, 8, 40},
+		{256, false, 8, 256},
+		{257, false, 24, 0},
+		{16, true, 4, 16},
+		{100, true, 8, 256},
+	}
+
+	for _, tt := range tests {
+		m := makeTestNRGBA(50, 20, func(x, y int) color.NRGBA {
+			v := (y*50 + x) % tt.nColors
+			if tt.gray {
+				return color.NRGBA{uint8(v), uint8(v), uint8(v), 255}
+			}
+			return color.NRGBA{uint8(v), uint8(v >> 8), uint8(v * 7), 255}
+		})
+		opts := new(EncoderOptions)
+		opts.SetAutoPalette(true)
+		info, m2 := roundTrip(t, m, opts)
+		if info.BitCount != tt.bitCount || info.PaletteEntries != tt.paletteEntries {
+			t.Fatalf("%d colors: got %d-bit image with %d palette entries\n", tt.nColors,
+				info.BitCount, info.PaletteEntries)
+		}
+		if tt.gray && tt.paletteEntries == 256 && info.Palette[100] != (color.RGBA{100, 100, 100, 255}) {
+			t.Fatalf("expected a grayscale palette\n")
+		}
+		comparePixels(t, fmt.Sprintf("%d colors", tt.nColors), m, m2, 0)
+	}
+}
+
+func TestEncodeOptimizePalette(t *testing.T) {
+	m := makeTestPaletted(30, 8, 256)
+	for i := range m.Pix {
+		m.Pix[i] = []uint8{10, 200, 77, 200}[i%4]
+	}
+	lum := func(c color.Color) uint32 {
+		r, g, b, _ := c.RGBA()
+		return 299*r + 587*g + 114*b
+	}
+
+	for _, order := range []PaletteOrder{PaletteOrderNone, PaletteOrderFrequency, PaletteOrderLuminance} {
+		opts := new(EncoderOptions)
+		opts.SetTrimPalette(true)
+		opts.SetPaletteOrder(order)
+		info, m2 := roundTrip(t, m, opts)
+		if info.BitCount != 4 || info.PaletteEntries != 3 {
+			t.Fatalf("order %d: got %d-bit image with %d colors\n", order, info.BitCount, info.PaletteEntries)
+		}
+		switch order {
+		case PaletteOrderNone:
+			if info.Palette[0] != color.RGBAModel.Convert(m.Palette[10]) {
+				t.Fatalf("palette order was not preserved\n")
+			}
+		case PaletteOrderFrequency:
+			if info.Palette[0] != color.RGBAModel.Convert(m.Palette[200]) {
+				t.Fatalf("most frequent color is not first\n")
+			}
+		case PaletteOrderLuminance:
+			if lum(info.Palette[0]) > lum(info.Palette[1]) || lum(info.Palette[1]) > lum(info.Palette[2]) {
+				t.Fatalf("palette is not sorted by luminance\n")
+			}
+		}
+		comparePixels(t, fmt.Sprintf("order %d", order), m, m2, 0)
+	}
+
+	// A grayscale image with 2 gray levels can be written as 1-bit.
+	gm := image.NewGray(image.Rect(0, 0, 10, 10))
+	for i := range gm.Pix {
+		gm.Pix[i] = uint8(i%2) * 200
+	}
+	opts := new(EncoderOptions)
+	opts.SetTrimPalette(true)
+	info, m3 := roundTrip(t, gm, opts)
+	if info.BitCount != 1 || info.PaletteEntries != 2 {
+		t.Fatalf("expected a 2-color image\n")
+	}
+	comparePixels(t, "gray", gm, m3, 0)
+}
+
+// Sorting the palette should give the same result for any order of the
+// source palette, even if colors have the same frequency or luminance.
+func TestEncodePaletteOrderDeterministic(t *testing.T) {
+	// The first two colors have the same luminance.
+	pal := color.Palette{color.RGBA{100, 50, 100, 255}, color.RGBA{40, 86, 72, 255},
+		color.RGBA{200, 10, 10, 255}, color.RGBA{5, 5, 5, 255}}
+	m1 := image.NewPaletted(image.Rect(0, 0, 8, 4), pal)
+	m2 := image.NewPaletted(m1.Rect, color.Palette{pal[3], pal[2], pal[1], pal[0]})
+	for i := range m1.Pix {
+		m1.Pix[i] = uint8(i % 4)
+		m2.Pix[i] = 3 - m1.Pix[i]
+	}
+
+	for _, order := range []PaletteOrder{PaletteOrderFrequency, PaletteOrderLuminance} {
+		opts := new(EncoderOptions)
+		opts.SetPaletteOrder(order)
+		if !bytes.Equal(encodeForTest(t, m1, opts), encodeForTest(t, m2, opts)) {
+			t.Fatalf("order %d: output depends on the source palette order\n", order)
+		}
+	}
+}
+
+func TestEncodePaletteAlpha(t *testing.T) {
+	m := makeTestPaletted(20, 6, 16)
+	m.Palette[1] = color.NRGBA{0, 0, 0, 0}
+	m.Palette[2] = color.NRGBA{0x40, 0x80, 0xc0, 0x80}
+
+	opts := new(EncoderOptions)
+	opts.SupportTransparency(true)
+	opts.WritePaletteAlpha(true)
+	dopts := new(DecoderOptions)
+	dopts.ReadPaletteAlpha(true)
+	info, m2 := inspectAndDecode(t, encodeForTest(t, m, opts), dopts)
+	if info.BitCount != 4 || info.PaletteEntries != 16 {
+		t.Fatalf("got %d-bit image with %d colors\n", info.BitCount, info.PaletteEntries)
+	}
+	p2 := m2.(*image.Paletted)
+	if !bytes.Equal(p2.Pix, m.Pix) {
+		t.Fatalf("pixels differ\n")
+	}
+	for i := range m.Palette {
+		c1 := color.NRGBAModel.Convert(m.Palette[i])
+		c2 := color.NRGBAModel.Convert(p2.Palette[i])
+		if c1 != c2 {
+			t.Fatalf("palette entry %d: expected %v, got %v\n", i, c1, c2)
+		}
+	}
+
+	// Without the option, the image is written as a 32-bit image.
+	opts.WritePaletteAlpha(false)
+	info, _ = roundTrip(t, m, opts)
+	if info.BitCount != 32 {
+		t.Fatalf("expected a 32-bit image, got %d-bit\n", info.BitCount)
+	}
+
+	// A palette that has to be rebuilt keeps its alpha values.
+	m3 := makeTestPaletted(20, 6, 256)
+	m3.Palette[201] = color.NRGBA{0, 0, 0, 0}
+	m3.Palette[202] = color.NRGBA{0x40, 0x80, 0xc0, 0x80}
+	for i := range m3.Pix {
+		m3.Pix[i] = uint8(200 + i%10)
+	}
+	opts.WritePaletteAlpha(true)
+	opts.SetBitCount(4)
+	info, m4 := inspectAndDecode(t, encodeForTest(t, m3, opts), dopts)
+	if info.BitCount != 4 || info.PaletteEntries != 10 {
+		t.Fatalf("got %d-bit image with %d colors\n", info.BitCount, info.PaletteEntries)
+	}
+	comparePixels(t, "4-bit", m3, m4, 0)
+}
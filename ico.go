@@ -0,0 +1,173 @@
+// ◄◄◄ gobmp/ico.go ►►►
+// Copyright © 2012 Jason Summers
+// Use of this code is governed by an MIT-style license that can
+// be found in the readme.md file.
+//
+// ICO and CUR encoder
+//
+
+package gobmp
+
+import "bytes"
+import "context"
+import "image"
+import "image/png"
+import "io"
+import "fmt"
+
+// An IconImage is one of the images in an icon or cursor file.
+type IconImage struct {
+	Image image.Image
+
+	// If PNG is true, the image is stored in PNG format. Otherwise, it is
+	// stored in BMP format, with a transparency mask.
+	PNG bool
+
+	// The position of a cursor's hotspot, relative to the top-left corner of
+	// the image. Ignored for icons.
+	Hotspot image.Point
+}
+
+// EncodeIcon writes the images to w in Windows icon (ICO) format. Each image
+// may be up to 256 pixels wide and high.
+func EncodeIcon(w io.Writer, images []IconImage) error {
+	return encodeIconFile(w, images, 1)
+}
+
+// EncodeCursor writes the images to w in Windows cursor (CUR) format. Each
+// image may be up to 256 pixels wide and high.
+func EncodeCursor(w io.Writer, images []IconImage) error {
+	return encodeIconFile(w, images, 2)
+}
+
+// Encode one image in BMP format, as it is stored in an ICO or CUR file:
+// a BITMAPINFOHEADER, palette, and bits, followed by the AND mask.
+// Returns the encoded image, its bit count, and its number of palette colors.
+func encodeIconDIB(m image.Image) ([]byte, int, int, error) {
+	var err error
+	var buf bytes.Buffer
+
+	e := new(encoder)
+	e.ctx = context.Background()
+	e.w = &buf
+	e.m = m
+	e.opts = new(EncoderOptions)
+	e.opts.supportTrns = true
+	e.forIcon = true
+
+	err = e.strategize()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	maskStride := ((e.width + 31) / 32) * 4
+	maskSize := e.height * maskStride
+
+	h := make([]byte, e.headerSize)
+	e.generateInfoHeader(h)
+	// The height includes both the image and the mask.
+	setDWORD(h[8:12], uint32(2*e.height))
+	setDWORD(h[20:24], uint32(e.dstBitsSize+maskSize))
+	buf.Write(h)
+
+	err = e.writePalette()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	bitsStart := buf.Len()
+	err = e.writeBits()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	// Write the AND mask, in which a 1 bit means the pixel is transparent.
+	// If the image isn't opaque, it has an alpha channel, from which we make
+	// the mask.
+	mask := make([]byte, maskSize)
+	if e.writeAlpha {
+		bits := buf.Bytes()[bitsStart:]
+		for j := 0; j < e.height; j++ {
+			for i := 0; i < e.width; i++ {
+				if bits[j*e.dstStride+i*4+3] == 0 {
+					mask[j*maskStride+i/8] |= uint8(1 << uint(7-i%8))
+				}
+			}
+		}
+	}
+	buf.Write(mask)
+
+	return buf.Bytes(), e.dstBitCount, e.nColors, nil
+}
+
+func encodeIconFile(w io.Writer, images []IconImage, fileType int) error {
+	var err error
+
+	if len(images) < 1 || len(images) > 65535 {
+		return UnsupportedError(fmt.Sprintf("icon with %d images", len(images)))
+	}
+
+	dir := make([]byte, 6+16*len(images))
+	setWORD(dir[2:4], uint16(fileType))
+	setWORD(dir[4:6], uint16(len(images)))
+
+	data := make([][]byte, len(images))
+	offset := len(dir)
+
+	for n, img := range images {
+		b := img.Image.Bounds()
+		if b.Dx() < 1 || b.Dy() < 1 || b.Dx() > 256 || b.Dy() > 256 {
+			return UnsupportedError(fmt.Sprintf("icon dimensions %dx%d", b.Dx(), b.Dy()))
+		}
+
+		if fileType == 2 && (img.Hotspot.X < 0 || img.Hotspot.Y < 0 ||
+			img.Hotspot.X >= b.Dx() || img.Hotspot.Y >= b.Dy()) {
+			return UnsupportedError(fmt.Sprintf("cursor hotspot %v outside of image", img.Hotspot))
+		}
+
+		bitCount := 32
+		nColors := 0
+		if img.PNG {
+			var buf bytes.Buffer
+			err = png.Encode(&buf, img.Image)
+			if err != nil {
+				return err
+			}
+			data[n] = buf.Bytes()
+		} else {
+			data[n], bitCount, nColors, err = encodeIconDIB(img.Image)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Write the ICONDIRENTRY. A width or height of 256 is stored as 0.
+		entry := dir[6+16*n : 6+16*(n+1)]
+		entry[0] = uint8(b.Dx())
+		entry[1] = uint8(b.Dy())
+		if bitCount < 8 {
+			entry[2] = uint8(nColors) // Number of palette colors
+		}
+		if fileType == 2 {
+			setWORD(entry[4:6], uint16(img.Hotspot.X))
+			setWORD(entry[6:8], uint16(img.Hotspot.Y))
+		} else {
+			setWORD(entry[4:6], 1) // Planes
+			setWORD(entry[6:8], uint16(bitCount))
+		}
+		setDWORD(entry[8:12], uint32(len(data[n])))
+		setDWORD(entry[12:16], uint32(offset))
+		offset += len(data[n])
+	}
+
+	_, err = w.Write(dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range data {
+		_, err = w.Write(d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
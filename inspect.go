@@ -0,0 +1,185 @@
+// ◄◄◄ gobmp/inspect.go ►►►
+// Copyright © 2012 Jason Summers
+// Use of this code is governed by an MIT-style license that can
+// be found in the readme.md file.
+//
+// BMP header inspection
+//
+
+package gobmp
+
+import "image/color"
+import "io"
+import "fmt"
+
+// A Compression is the value of a BMP file's biCompression field.
+type Compression uint32
+
+// Known Compression values.
+const (
+	CompressionRGB            Compression = bI_RGB
+	CompressionRLE8           Compression = bI_RLE8
+	CompressionRLE4           Compression = bI_RLE4
+	CompressionBitFields      Compression = bI_BITFIELDS
+	CompressionJPEG           Compression = 4
+	CompressionPNG            Compression = 5
+	CompressionAlphaBitFields Compression = bI_ALPHABITFIELDS
+)
+
+var compressionNames = map[Compression]string{
+	CompressionRGB:            "BI_RGB",
+	CompressionRLE8:           "BI_RLE8",
+	CompressionRLE4:           "BI_RLE4",
+	CompressionBitFields:      "BI_BITFIELDS",
+	CompressionJPEG:           "BI_JPEG",
+	CompressionPNG:            "BI_PNG",
+	CompressionAlphaBitFields: "BI_ALPHABITFIELDS",
+}
+
+func (c Compression) String() string {
+	if s, ok := compressionNames[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("Compression(%d)", uint32(c))
+}
+
+// A HeaderType identifies the version of a BMP file's info header. Its value
+// is the size of the header in bytes.
+type HeaderType int
+
+// Commonly used HeaderType values. OS/2 v2 headers may have any of several
+// sizes; HeaderOS2v2 is the full-size version.
+const (
+	HeaderCore  HeaderType = 12  // BITMAPCOREHEADER (OS/2 1.x)
+	HeaderInfo  HeaderType = 40  // BITMAPINFOHEADER (Windows 3.x)
+	HeaderV2    HeaderType = 52  // BITMAPV2INFOHEADER
+	HeaderV3    HeaderType = 56  // BITMAPV3INFOHEADER
+	HeaderOS2v2 HeaderType = 64  // OS22XBITMAPHEADER
+	HeaderV4    HeaderType = 108 // BITMAPV4HEADER
+	HeaderV5    HeaderType = 124 // BITMAPV5HEADER
+)
+
+func (h HeaderType) String() string {
+	switch h {
+	case HeaderCore:
+		return "BITMAPCOREHEADER"
+	case HeaderInfo:
+		return "BITMAPINFOHEADER"
+	case HeaderV2:
+		return "BITMAPV2INFOHEADER"
+	case HeaderV3:
+		return "BITMAPV3INFOHEADER"
+	case HeaderV4:
+		return "BITMAPV4HEADER"
+	case HeaderV5:
+		return "BITMAPV5HEADER"
+	case 16, 20, 24, 32, 36, 42, 44, 46, 48, 60, HeaderOS2v2:
+		return "OS22XBITMAPHEADER"
+	}
+	return fmt.Sprintf("HeaderType(%d)", int(h))
+}
+
+// Info describes the headers of a BMP file, as returned by Inspect.
+// Fields that are not present in the file's version of the header are 0.
+type Info struct {
+	FileSize uint32 // bfSize
+	OffBits  uint32 // bfOffBits
+
+	HeaderType    HeaderType // The header size (biSize)
+	Width         int
+	Height        int  // Always positive; see TopDown
+	TopDown       bool // True if biHeight is negative
+	Planes        int
+	BitCount      int
+	Compression   Compression
+	SizeImage     uint32
+	XPelsPerMeter int32
+	YPelsPerMeter int32
+	ClrUsed       uint32
+	ClrImportant  uint32
+
+	// The bitfields masks in effect. For 16- and 32-bit BI_RGB images, these
+	// are the default masks.
+	RedMask       uint32
+	GreenMask     uint32
+	BlueMask      uint32
+	AlphaMask     uint32
+	BitFieldsSize int // Size of the separate BITFIELDS segment, if any
+
+	// Color space fields from V4 and V5 headers.
+	CSType      uint32
+	Endpoints   [9]uint32 // CIEXYZTRIPLE, as FXPT2DOT30 values
+	Gamma       [3]uint32 // Red, green, and blue gamma, as 16.16 values
+	Intent      uint32
+	ProfileData uint32
+	ProfileSize uint32
+
+	PaletteEntries   int // Number of palette entries stored in the file
+	PaletteEntrySize int // Bytes per palette entry (3 or 4)
+	Palette          color.Palette
+
+	// Number of unused bytes between the palette and the bitmap bits.
+	// Negative if OffBits points to a location before the end of the palette.
+	GapSize int
+}
+
+// Inspect reads the headers and palette of the BMP image in r, and returns
+// a description of them. It does not decode the image bits, and does not
+// require that the image use a supported type of compression.
+func Inspect(r io.Reader) (*Info, error) {
+	var err error
+
+	d := new(decoder)
+	d.r = r
+	d.opts = new(DecoderOptions)
+
+	err = d.readHeaders(false)
+	if err != nil {
+		return nil, err
+	}
+	if d.hasBitFieldsSegment {
+		err = d.readBitFieldsSegment()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if d.srcPalNumEntries > 0 {
+		err = d.readPalette()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info := &Info{
+		FileSize:         d.bfSize,
+		OffBits:          d.bfOffBits,
+		HeaderType:       HeaderType(d.headerSize),
+		Width:            d.width,
+		Height:           d.height,
+		TopDown:          d.isTopDown,
+		Planes:           d.planes,
+		BitCount:         d.bitCount,
+		Compression:      Compression(d.biCompression),
+		SizeImage:        d.biSizeImage,
+		XPelsPerMeter:    d.xPelsPerMeter,
+		YPelsPerMeter:    d.yPelsPerMeter,
+		ClrUsed:          d.biClrUsed,
+		ClrImportant:     d.biClrImportant,
+		RedMask:          d.bitFields[0].mask,
+		GreenMask:        d.bitFields[1].mask,
+		BlueMask:         d.bitFields[2].mask,
+		AlphaMask:        d.bitFields[3].mask,
+		BitFieldsSize:    d.bitFieldsSegmentSize,
+		CSType:           d.csType,
+		Endpoints:        d.endpoints,
+		Gamma:            d.gamma,
+		Intent:           d.intent,
+		ProfileData:      d.profileData,
+		ProfileSize:      d.profileSize,
+		PaletteEntries:   d.srcPalNumEntries,
+		PaletteEntrySize: d.srcPalBytesPerEntry,
+		Palette:          d.dstPalette,
+		GapSize:          d.gapSize(),
+	}
+	return info, nil
+}
@@ -0,0 +1,288 @@
+// ◄◄◄ gobmp/palette.go ►►►
+// Copyright © 2012 Jason Summers
+// Use of this code is governed by an MIT-style license that can
+// be found in the readme.md file.
+//
+// Palette construction for the BMP encoder
+//
+
+package gobmp
+
+import "image"
+import "image/color"
+import "fmt"
+import "sort"
+
+// A PaletteOrder is a way of sorting a palette. See
+// EncoderOptions.SetPaletteOrder.
+type PaletteOrder int
+
+// Supported PaletteOrder values.
+const (
+	PaletteOrderNone      PaletteOrder = iota // Keep the original order
+	PaletteOrderFrequency                     // Most frequently used colors first
+	PaletteOrderLuminance                     // Darkest colors first
+)
+
+// SetTrimPalette causes palette entries that are not used by any pixel to be
+// removed, when writing a paletted image. This may allow the image to be
+// written with fewer bits per pixel.
+func (opts *EncoderOptions) SetTrimPalette(b bool) {
+	opts.trimPalette = b
+}
+
+// SetPaletteOrder sets the order in which to write the palette entries, when
+// writing a paletted image. The default is PaletteOrderNone. Colors with the
+// same sort key are ordered by their color values, so the result does not
+// depend on the order of the original palette.
+func (opts *EncoderOptions) SetPaletteOrder(o PaletteOrder) {
+	opts.paletteOrder = o
+}
+
+// Make sure the image can be written as a paletted image with the given bit
+// count, building a new palette if necessary.
+func (e *encoder) fitPalette(bitCount int) error {
+	maxColors := 1 << uint(bitCount)
+	if e.writePaletted && e.nColors <= maxColors {
+		return nil
+	}
+
+	e.writePaletted = false
+	e.srcIsGray = false
+	e.m_AsPaletted = nil
+	e.nColors = 0
+
+	if e.makeExactPalette(maxColors) {
+		return nil
+	}
+	if e.opts.quantize {
+		// The quantized palette doesn't preserve transparency.
+		e.rleSkipTrns = false
+		e.rleTrns = [256]bool{}
+		return e.quantize(maxColors)
+	}
+	return UnsupportedError(fmt.Sprintf("%d-bit output of an image with more than %d colors requires quantization",
+		bitCount, maxColors))
+}
+
+// Try to make a palette that contains every color in the image. If there are
+// no more than maxColors colors, sets e.m_AsPaletted to a paletted copy of the
+// image, sets the related fields, and returns true.
+// If the image needs an 8-bit palette, and all its colors are gray, uses a
+// grayscale palette instead.
+// Transparency is discarded, unless alpha values are to be written in the
+// palette, or transparent pixels are to be skipped using RLE codes. In the
+// latter case, e.rleTrns is updated to match the new palette.
+func (e *encoder) makeExactPalette(maxColors int) bool {
+	keepAlpha := e.rleSkipTrns || e.usePaletteAlpha()
+	if p, ok := e.m.(*image.Paletted); ok {
+		e.makePalBGRA(p, keepAlpha)
+	}
+
+	pm := image.NewPaletted(image.Rect(0, 0, e.width, e.height), nil)
+	index := make(map[[4]uint8]uint8)
+	var genRowFunc func(e *encoder, j int, rowBuf []byte)
+	bpp := 3
+	if keepAlpha {
+		genRowFunc = generateRow_32
+		bpp = 4
+	} else {
+		genRowFunc = generateRow_24
+	}
+	rowBuf := make([]byte, bpp*e.width)
+	allGray := true
+
+	for j := 0; j < e.height; j++ {
+		genRowFunc(e, j, rowBuf)
+		for i := 0; i < e.width; i++ {
+			key := [4]uint8{0, 0, 0, 255}
+			copy(key[:], rowBuf[i*bpp:i*bpp+bpp])
+			v, ok := index[key]
+			if !ok {
+				if len(pm.Palette) >= maxColors {
+					return false
+				}
+				v = uint8(len(pm.Palette))
+				index[key] = v
+				if key[0] != key[1] || key[0] != key[2] || key[3] != 255 {
+					allGray = false
+				}
+				pm.Palette = append(pm.Palette, color.NRGBA{key[2], key[1], key[0], key[3]})
+			}
+			pm.Pix[j*pm.Stride+i] = v
+		}
+	}
+
+	e.writePaletted = true
+	if allGray && maxColors == 256 && len(pm.Palette) > 16 {
+		e.srcIsGray = true
+		e.nColors = 256
+		return true
+	}
+
+	e.m_AsPaletted = pm
+	e.nColors = len(pm.Palette)
+	if e.nColors < 1 {
+		e.nColors = 1 // Only possible for an empty image
+		pm.Palette = append(pm.Palette, color.RGBA{0, 0, 0, 255})
+	}
+
+	if e.rleSkipTrns {
+		e.rleTrns = [256]bool{}
+		e.rleSkipTrns = false
+		for i, c := range pm.Palette {
+			if c.(color.NRGBA).A == 0 {
+				e.rleTrns[i] = true
+				e.rleSkipTrns = true
+			}
+		}
+	}
+	return true
+}
+
+// WritePaletteAlpha causes paletted images whose palettes have transparent
+// colors to be written as paletted images, with each entry's alpha value in
+// its reserved byte. Otherwise, such images are written in 32-bit format if
+// transparency is supported (see SupportTransparency), or without
+// transparency if not. Few applications read palette alpha values; see
+// DecoderOptions.ReadPaletteAlpha. Readers are likely to treat a palette
+// whose entries are all fully transparent as opaque.
+//
+// This applies to *image.Paletted images, and has no effect if a bit count of
+// 16 or more is requested. If the image has to be quantized to fit a
+// requested bit count, its palette will not have alpha values.
+func (opts *EncoderOptions) WritePaletteAlpha(b bool) {
+	opts.paletteAlpha = b
+}
+
+// Returns true if the image is a paletted image that may be written with
+// alpha values in its palette, instead of as a 32-bit image.
+func (e *encoder) usePaletteAlpha() bool {
+	if !e.opts.paletteAlpha || e.opts.format16 != 0 {
+		return false
+	}
+	p, ok := e.m.(*image.Paletted)
+	return ok && len(p.Palette) >= 1 && len(p.Palette) <= 256
+}
+
+// Decide whether to write alpha values in the palette, and set e.palAlpha
+// accordingly.
+func (e *encoder) checkPaletteAlpha() {
+	if !e.writePaletted || e.srcIsGray || !e.usePaletteAlpha() {
+		return
+	}
+	for _, c := range e.m_AsPaletted.Palette[:e.nColors] {
+		_, _, _, a := c.RGBA()
+		if a < 0xffff {
+			e.palAlpha = true
+			return
+		}
+	}
+}
+
+// Reports whether c1 sorts before c2, comparing red, green, blue, then alpha.
+// Used to break ties when sorting a palette.
+func colorLess(c1, c2 color.Color) bool {
+	r1, g1, b1, a1 := c1.RGBA()
+	r2, g2, b2, a2 := c2.RGBA()
+	if r1 != r2 {
+		return r1 < r2
+	}
+	if g1 != g2 {
+		return g1 < g2
+	}
+	if b1 != b2 {
+		return b1 < b2
+	}
+	return a1 < a2
+}
+
+// If requested, remove unused palette entries and sort the palette. This
+// makes a new, remapped copy of the image in e.m_AsPaletted.
+func (e *encoder) optimizePalette() {
+	if !e.writePaletted || (!e.opts.trimPalette && e.opts.paletteOrder == PaletteOrderNone) {
+		return
+	}
+
+	src := e.m_AsPaletted
+	if e.srcIsGray {
+		// Make an indexed copy of the image, so that it can be remapped.
+		grayPal := make(color.Palette, 256)
+		for i := range grayPal {
+			grayPal[i] = color.RGBA{uint8(i), uint8(i), uint8(i), 255}
+		}
+		src = image.NewPaletted(image.Rect(0, 0, e.width, e.height), grayPal)
+		for j := 0; j < e.height; j++ {
+			generateRow_GrayPal(e, j, src.Pix[j*src.Stride:])
+		}
+	}
+
+	var counts [256]int
+	for j := 0; j < e.height; j++ {
+		for _, v := range src.Pix[j*src.Stride : j*src.Stride+e.width] {
+			counts[v]++
+		}
+	}
+
+	// order lists the old palette indices, in their new order.
+	order := make([]int, 0, e.nColors)
+	for i := 0; i < e.nColors; i++ {
+		if counts[i] > 0 || !e.opts.trimPalette {
+			order = append(order, i)
+		}
+	}
+	if len(order) == 0 {
+		order = append(order, 0) // Only possible for an empty image
+	}
+
+	switch e.opts.paletteOrder {
+	case PaletteOrderFrequency:
+		sort.SliceStable(order, func(a, b int) bool {
+			if counts[order[a]] != counts[order[b]] {
+				return counts[order[a]] > counts[order[b]]
+			}
+			return colorLess(src.Palette[order[a]], src.Palette[order[b]])
+		})
+	case PaletteOrderLuminance:
+		luminance := func(idx int) uint32 {
+			r, g, b, _ := src.Palette[idx].RGBA()
+			return 299*r + 587*g + 114*b
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			if luminance(order[a]) != luminance(order[b]) {
+				return luminance(order[a]) < luminance(order[b])
+			}
+			return colorLess(src.Palette[order[a]], src.Palette[order[b]])
+		})
+	}
+
+	var remap [256]uint8 // Maps old indices to new indices
+	pal := make(color.Palette, len(order))
+	for n, idx := range order {
+		remap[idx] = uint8(n)
+		pal[n] = src.Palette[idx]
+	}
+
+	dst := image.NewPaletted(image.Rect(0, 0, e.width, e.height), pal)
+	for j := 0; j < e.height; j++ {
+		for i := 0; i < e.width; i++ {
+			dst.Pix[j*dst.Stride+i] = remap[src.Pix[j*src.Stride+i]]
+		}
+	}
+
+	if e.rleSkipTrns {
+		var trns [256]bool
+		e.rleSkipTrns = false
+		for n, idx := range order {
+			if e.rleTrns[idx] {
+				trns[n] = true
+				e.rleSkipTrns = true
+			}
+		}
+		e.rleTrns = trns
+	}
+
+	e.m_AsPaletted = dst
+	e.nColors = len(pal)
+	e.srcIsGray = false
+}
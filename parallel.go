@@ -0,0 +1,82 @@
+// ◄◄◄ gobmp/parallel.go ►►►
+// Copyright © 2012 Jason Summers
+// Use of this code is governed by an MIT-style license that can
+// be found in the readme.md file.
+//
+// Parallel row processing
+//
+
+package gobmp
+
+import "runtime"
+import "sync"
+
+// Target number of bytes of row data to process at a time, when working in
+// parallel.
+const parallelChunkBytes = 1 << 20
+
+// Translates a concurrency setting into a number of worker goroutines.
+func numWorkers(concurrency int) int {
+	if concurrency < 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	if concurrency == 0 {
+		return 1
+	}
+	return concurrency
+}
+
+// Returns the number of rows to process at a time, given the size of a row.
+func rowsPerChunk(workers int, rowSize int, height int) int {
+	n := parallelChunkBytes / rowSize
+	if n < 4*workers {
+		n = 4 * workers
+	}
+	if n > height {
+		n = height
+	}
+	return n
+}
+
+// Calls fn(w, j) for each j from 0 to n-1, using up to 'workers' goroutines.
+// Each goroutine handles a contiguous range of j values, and is identified by
+// w, which is less than 'workers'. Returns the error for the lowest j for
+// which fn returned an error, if any.
+func parallelRows(n int, workers int, fn func(w, j int) error) error {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for j := 0; j < n; j++ {
+			err := fn(0, j)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for j := n * w / workers; j < n*(w+1)/workers; j++ {
+				err := fn(w, j)
+				if err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+// ◄◄◄ gobmp/quant.go ►►►
+// Copyright © 2012 Jason Summers
+// Use of this code is governed by an MIT-style license that can
+// be found in the readme.md file.
+//
+// Color quantization
+//
+
+package gobmp
+
+import "image"
+import "image/color"
+import "image/draw"
+import "sort"
+
+// SetQuantization enables color quantization, which lets an image with too
+// many colors be written as a paletted image. When enabled, images that would
+// otherwise be written in 24-bit format are instead written with a palette of
+// up to 256 colors, and SetBitCount can request 1-, 2-, 4-, or 8-bit output
+// for any image. Images with few enough colors are not quantized.
+func (opts *EncoderOptions) SetQuantization(b bool) {
+	opts.quantize = b
+}
+
+// SetQuantizer sets the Quantizer used to make a palette, when quantization is
+// enabled. The default, nil, means to use a MedianCutQuantizer.
+func (opts *EncoderOptions) SetQuantizer(q draw.Quantizer) {
+	opts.quantizer = q
+}
+
+// SetDrawer sets the Drawer used to convert an image to a palette made by the
+// Quantizer. The default, nil, means to use draw.FloydSteinberg if the
+// dither mode is DitherFloydSteinberg, or draw.Src if it is DitherNone.
+// DitherOrdered is not supported by the default Drawer.
+func (opts *EncoderOptions) SetDrawer(d draw.Drawer) {
+	opts.drawer = d
+}
+
+// MedianCutQuantizer is a draw.Quantizer that makes a palette using the
+// median cut algorithm. Transparency is ignored; the colors in the palette
+// are opaque.
+type MedianCutQuantizer struct{}
+
+type mcColor struct {
+	c [3]uint8 // R, G, B
+	n int      // Number of pixels of this color
+}
+
+// A box is a set of colors that will be represented by one palette entry.
+type mcBox []mcColor
+
+// Returns the channel with the largest range of values in the box, and
+// the size of that range.
+func (b mcBox) widestChannel() (int, int) {
+	var bestK, bestRange int
+	for k := 0; k < 3; k++ {
+		lo, hi := 255, 0
+		for _, mc := range b {
+			v := int(mc.c[k])
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo > bestRange {
+			bestK, bestRange = k, hi-lo
+		}
+	}
+	return bestK, bestRange
+}
+
+// Sort the colors in the box by the value of channel k. This is a counting
+// sort, so it is stable.
+func (b mcBox) sortByChannel(k int) {
+	var start [257]int
+	for _, mc := range b {
+		start[int(mc.c[k])+1]++
+	}
+	for v := 1; v < 257; v++ {
+		start[v] += start[v-1]
+	}
+	sorted := make(mcBox, len(b))
+	for _, mc := range b {
+		sorted[start[mc.c[k]]] = mc
+		start[mc.c[k]]++
+	}
+	copy(b, sorted)
+}
+
+// Returns the average color of the pixels in the box.
+func (b mcBox) average() color.Color {
+	var sum [3]int
+	var total int
+	for _, mc := range b {
+		for k := 0; k < 3; k++ {
+			sum[k] += int(mc.c[k]) * mc.n
+		}
+		total += mc.n
+	}
+	var avg [3]uint8
+	for k := 0; k < 3; k++ {
+		avg[k] = uint8((sum[k] + total/2) / total)
+	}
+	return color.RGBA{avg[0], avg[1], avg[2], 255}
+}
+
+// Quantize appends up to cap(p) - len(p) colors to p, chosen to represent
+// the colors in m, and returns the updated palette.
+func (q MedianCutQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	maxColors := cap(p) - len(p)
+	if maxColors < 1 {
+		return p
+	}
+
+	// Make a histogram of the colors in the image.
+	counts := make(map[[3]uint8]int)
+	b := m.Bounds()
+	for j := b.Min.Y; j < b.Max.Y; j++ {
+		for i := b.Min.X; i < b.Max.X; i++ {
+			r, g, b, _ := m.At(i, j).RGBA()
+			counts[[3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)}]++
+		}
+	}
+	if len(counts) == 0 {
+		return p
+	}
+
+	all := make(mcBox, 0, len(counts))
+	for c, n := range counts {
+		all = append(all, mcColor{c, n})
+	}
+	// Sort, so that the result does not depend on the order of map iteration.
+	sort.Slice(all, func(a, b int) bool {
+		ca, cb := all[a].c, all[b].c
+		return ca[0] < cb[0] || (ca[0] == cb[0] && (ca[1] < cb[1] ||
+			(ca[1] == cb[1] && ca[2] < cb[2])))
+	})
+
+	// For each box, remember its widest channel and the range of that channel.
+	type boxInfo struct {
+		box     mcBox
+		k, size int
+	}
+	newBoxInfo := func(box mcBox) boxInfo {
+		k, size := box.widestChannel()
+		return boxInfo{box, k, size}
+	}
+
+	boxes := []boxInfo{newBoxInfo(all)}
+	for len(boxes) < maxColors {
+		// Split the box with the widest range of values in any channel.
+		bestIdx, bestSize := -1, 0
+		for idx := range boxes {
+			if boxes[idx].size > bestSize {
+				bestIdx, bestSize = idx, boxes[idx].size
+			}
+		}
+		if bestIdx < 0 {
+			break // Every box has only one color
+		}
+
+		box, k := boxes[bestIdx].box, boxes[bestIdx].k
+		box.sortByChannel(k)
+
+		// Split at the median pixel, keeping at least one color on each side.
+		var total, half int
+		for _, mc := range box {
+			total += mc.n
+		}
+		split := 1
+		for split < len(box)-1 {
+			half += box[split-1].n
+			if 2*half >= total {
+				break
+			}
+			split++
+		}
+		boxes[bestIdx] = newBoxInfo(box[:split])
+		boxes = append(boxes, newBoxInfo(box[split:]))
+	}
+
+	for _, bi := range boxes {
+		p = append(p, bi.box.average())
+	}
+	return p
+}
+
+// Make a palette of up to maxColors colors, and set e.m_AsPaletted to a copy
+// of the image that uses it.
+func (e *encoder) quantize(maxColors int) error {
+	quantizer := e.opts.quantizer
+	if quantizer == nil {
+		quantizer = MedianCutQuantizer{}
+	}
+	drawer := e.opts.drawer
+	if drawer == nil {
+		switch e.opts.dither {
+		case DitherNone:
+			drawer = draw.Src
+		case DitherFloydSteinberg:
+			drawer = draw.FloydSteinberg
+		default:
+			return UnsupportedError("ordered dithering to a palette")
+		}
+	}
+
+	pal := quantizer.Quantize(make(color.Palette, 0, maxColors), e.m)
+	if len(pal) < 1 {
+		return UnsupportedError("empty palette from quantizer")
+	}
+	if len(pal) > maxColors {
+		pal = pal[:maxColors]
+	}
+
+	pm := image.NewPaletted(image.Rect(0, 0, e.width, e.height), pal)
+	drawer.Draw(pm, pm.Bounds(), e.m, e.srcBounds.Min)
+
+	e.m_AsPaletted = pm
+	e.nColors = len(pal)
+	e.writePaletted = true
+	return nil
+}
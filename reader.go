@@ -9,6 +9,7 @@
 // Package gobmp implements a BMP image decoder and encoder.
 package gobmp
 
+import "context"
 import "image"
 import "image/color"
 import "io"
@@ -19,28 +20,79 @@ const (
 	bI_RLE8      = 1
 	bI_RLE4      = 2
 	bI_BITFIELDS = 3
+
+	bI_ALPHABITFIELDS = 6
 )
 
 type bitFieldsInfo struct {
 	mask  uint32
 	shift uint
 	scale float64 // Amount to multiply the sample value by, to scale it to [0..255]
+	table []uint8 // Maps each sample value to [0..255]; see makeChannelTables
+}
+
+// DecoderOptions stores options that can be passed to DecodeWithOptions().
+// Create a DecoderOptions object with new().
+type DecoderOptions struct {
+	paletteAlpha bool
+	progressFn   func(rowsDone, rowsTotal int)
+	concurrency  int
+}
+
+// ReadPaletteAlpha indicates whether to interpret the fourth (normally
+// reserved) byte of each palette entry as an alpha value. If enabled, and the
+// image has a palette in which at least one such byte is nonzero, the decoded
+// image will have a palette of color.NRGBA colors.
+func (opts *DecoderOptions) ReadPaletteAlpha(a bool) {
+	opts.paletteAlpha = a
+}
+
+// SetProgressFunc sets a function to be called periodically while the image
+// bits are being decoded, to report how many rows have been decoded so far.
+func (opts *DecoderOptions) SetProgressFunc(f func(rowsDone, rowsTotal int)) {
+	opts.progressFn = f
+}
+
+// SetConcurrency sets the number of goroutines to use when decoding
+// uncompressed images. The default, 0 (or 1), decodes in the calling
+// goroutine. A negative value means to use runtime.GOMAXPROCS(0) goroutines.
+// Using more than one goroutine increases memory usage.
+func (opts *DecoderOptions) SetConcurrency(n int) {
+	opts.concurrency = n
 }
 
 type decoder struct {
-	r io.Reader
+	r    io.Reader
+	opts *DecoderOptions
+	ctx  context.Context
 
 	img_Paletted *image.Paletted // Used if dstHasPalette is true
 	img_NRGBA    *image.NRGBA    // Used otherwise
 
+	bfSize        uint32
 	bfOffBits     uint32
 	headerSize    uint32
 	width         int
 	height        int
+	planes        int
 	bitCount      int
 	biCompression uint32
 	isTopDown     bool
 
+	biSizeImage    uint32
+	xPelsPerMeter  int32
+	yPelsPerMeter  int32
+	biClrUsed      uint32
+	biClrImportant uint32
+
+	// Fields from V4 and V5 headers
+	csType      uint32
+	endpoints   [9]uint32
+	gamma       [3]uint32
+	intent      uint32
+	profileData uint32
+	profileSize uint32
+
 	srcPalNumEntries    int
 	srcPalBytesPerEntry int
 	srcPalSizeInBytes   int
@@ -48,6 +100,8 @@ type decoder struct {
 	dstHasPalette       bool
 	dstPalette          color.Palette
 
+	palMap [256]uint8 // Palette index remapping; see makePalMap
+
 	hasBitFieldsSegment  bool
 	bitFieldsSegmentSize int
 	bitFields            [4]bitFieldsInfo
@@ -71,31 +125,192 @@ func getDWORD(b []byte) uint32 {
 	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
 }
 
-func decodeRow_paletted(d *decoder, buf []byte, j int) error {
-	for i := 0; i < d.width; i++ {
-		var v byte
-
-		switch d.bitCount {
-		case 8:
-			v = buf[i]
-		case 4:
-			v = (buf[i/2] >> (4 * (1 - uint(i)%2))) & 0x0f
-		case 2:
-			v = (buf[i/4] >> (2 * (3 - uint(i)%4))) & 0x03
-		case 1:
-			v = (buf[i/8] >> (1 * (7 - uint(i)%8))) & 0x01
-		}
-		if int(v) >= d.dstPalNumEntries {
+// Prepare d.palMap, which maps each possible palette index to the index
+// that will be stored in the target image.
+func (d *decoder) makePalMap() {
+	for v := 0; v < 256; v++ {
+		if v < d.dstPalNumEntries {
+			d.palMap[v] = uint8(v)
+		} else {
 			// Out-of-range palette index.
 			// Most BMP viewers use the first palette color for such pixels, so
 			// that's what we'll do.
-			v = 0
+			d.palMap[v] = 0
+		}
+	}
+}
+
+// Lookup tables that unpack a byte into 8, 4, or 2 pixels.
+var unpackTable1 [256][8]uint8
+var unpackTable2 [256][4]uint8
+var unpackTable4 [256][2]uint8
+
+func init() {
+	for x := 0; x < 256; x++ {
+		for p := 0; p < 8; p++ {
+			unpackTable1[x][p] = uint8(x>>uint(7-p)) & 0x01
+		}
+		for p := 0; p < 4; p++ {
+			unpackTable2[x][p] = uint8(x>>uint(6-2*p)) & 0x03
+		}
+		for p := 0; p < 2; p++ {
+			unpackTable4[x][p] = uint8(x>>uint(4-4*p)) & 0x0f
+		}
+	}
+}
+
+// If the palette is smaller than the bit count allows, replace any
+// out-of-range palette indices in the row.
+func (d *decoder) fixPalIndices(dst []byte) {
+	if d.dstPalNumEntries >= 1<<uint(d.bitCount) {
+		return
+	}
+	for i := range dst {
+		dst[i] = d.palMap[dst[i]]
+	}
+}
+
+func decodeRow_1(d *decoder, buf []byte, j int) error {
+	dst := d.img_Paletted.Pix[j*d.img_Paletted.Stride : j*d.img_Paletted.Stride+d.width]
+	nFull := d.width / 8
+	for i := 0; i < nFull; i++ {
+		copy(dst[i*8:i*8+8], unpackTable1[buf[i]][:])
+	}
+	if nFull*8 < d.width {
+		copy(dst[nFull*8:], unpackTable1[buf[nFull]][:])
+	}
+	d.fixPalIndices(dst)
+	return nil
+}
+
+func decodeRow_2(d *decoder, buf []byte, j int) error {
+	dst := d.img_Paletted.Pix[j*d.img_Paletted.Stride : j*d.img_Paletted.Stride+d.width]
+	nFull := d.width / 4
+	for i := 0; i < nFull; i++ {
+		t := &unpackTable2[buf[i]]
+		dst[i*4] = t[0]
+		dst[i*4+1] = t[1]
+		dst[i*4+2] = t[2]
+		dst[i*4+3] = t[3]
+	}
+	if nFull*4 < d.width {
+		copy(dst[nFull*4:], unpackTable2[buf[nFull]][:])
+	}
+	d.fixPalIndices(dst)
+	return nil
+}
+
+func decodeRow_4(d *decoder, buf []byte, j int) error {
+	dst := d.img_Paletted.Pix[j*d.img_Paletted.Stride : j*d.img_Paletted.Stride+d.width]
+	nFull := d.width / 2
+	for i := 0; i < nFull; i++ {
+		t := &unpackTable4[buf[i]]
+		dst[i*2] = t[0]
+		dst[i*2+1] = t[1]
+	}
+	if nFull*2 < d.width {
+		dst[nFull*2] = unpackTable4[buf[nFull]][0]
+	}
+	d.fixPalIndices(dst)
+	return nil
+}
+
+func decodeRow_8(d *decoder, buf []byte, j int) error {
+	dst := d.img_Paletted.Pix[j*d.img_Paletted.Stride : j*d.img_Paletted.Stride+d.width]
+	if d.dstPalNumEntries == 256 {
+		copy(dst, buf)
+		return nil
+	}
+	for i := range dst {
+		dst[i] = d.palMap[buf[i]]
+	}
+	return nil
+}
+
+// Prepare a lookup table for each channel, which maps each possible sample
+// value to its [0..255] equivalent. Returns false if any channel has more
+// than 16 bits, or the tables would be larger than the image, making tables
+// impractical.
+func (d *decoder) makeChannelTables() bool {
+	tableSize := 0
+	for k := 0; k < 4; k++ {
+		tableSize += int(d.bitFields[k].mask>>d.bitFields[k].shift) + 1
+	}
+	if tableSize > d.width*d.height {
+		return false
+	}
+
+	for k := 0; k < 4; k++ {
+		bf := &d.bitFields[k]
+		if bf.mask == 0 {
+			if k == 3 {
+				// If alpha mask is missing, make the pixel opaque.
+				bf.table = []uint8{255}
+			} else {
+				// If some other mask is missing, who knows what to do?
+				bf.table = []uint8{0}
+			}
+			continue
+		}
+
+		maxVal := bf.mask >> bf.shift
+		if maxVal > 0xffff {
+			return false
+		}
+		bf.table = make([]uint8, maxVal+1)
+		for v := range bf.table {
+			bf.table[v] = uint8(0.5 + float64(v)*bf.scale)
+		}
+	}
+	return true
+}
+
+func decodeRow_16(d *decoder, buf []byte, j int) error {
+	dst := d.img_NRGBA.Pix[j*d.img_NRGBA.Stride : j*d.img_NRGBA.Stride+4*d.width]
+	bf := &d.bitFields
+	for i := 0; i < d.width; i++ {
+		v := uint32(buf[i*2]) | uint32(buf[i*2+1])<<8
+		dst[i*4] = bf[0].table[(v&bf[0].mask)>>bf[0].shift]
+		dst[i*4+1] = bf[1].table[(v&bf[1].mask)>>bf[1].shift]
+		dst[i*4+2] = bf[2].table[(v&bf[2].mask)>>bf[2].shift]
+		dst[i*4+3] = bf[3].table[(v&bf[3].mask)>>bf[3].shift]
+	}
+	return nil
+}
+
+func decodeRow_32(d *decoder, buf []byte, j int) error {
+	dst := d.img_NRGBA.Pix[j*d.img_NRGBA.Stride : j*d.img_NRGBA.Stride+4*d.width]
+	bf := &d.bitFields
+	for i := 0; i < d.width; i++ {
+		v := getDWORD(buf[i*4 : i*4+4])
+		dst[i*4] = bf[0].table[(v&bf[0].mask)>>bf[0].shift]
+		dst[i*4+1] = bf[1].table[(v&bf[1].mask)>>bf[1].shift]
+		dst[i*4+2] = bf[2].table[(v&bf[2].mask)>>bf[2].shift]
+		dst[i*4+3] = bf[3].table[(v&bf[3].mask)>>bf[3].shift]
+	}
+	return nil
+}
+
+// For 32-bit images in which each sample is a whole byte: B,G,R, and either
+// alpha or an unused byte.
+func decodeRow_32BGRA(d *decoder, buf []byte, j int) error {
+	dst := d.img_NRGBA.Pix[j*d.img_NRGBA.Stride : j*d.img_NRGBA.Stride+4*d.width]
+	hasAlpha := d.bitFields[3].mask != 0
+	for i := 0; i < d.width; i++ {
+		dst[i*4] = buf[i*4+2]
+		dst[i*4+1] = buf[i*4+1]
+		dst[i*4+2] = buf[i*4]
+		if hasAlpha {
+			dst[i*4+3] = buf[i*4+3]
+		} else {
+			dst[i*4+3] = 255
 		}
-		d.img_Paletted.Pix[j*d.img_Paletted.Stride+i] = v
 	}
 	return nil
 }
 
+// General-purpose decoder for 16- and 32-bit images, used if the samples are
+// too large for lookup tables.
 func decodeRow_16or32(d *decoder, buf []byte, j int) error {
 	for i := 0; i < d.width; i++ {
 		var v uint32
@@ -125,25 +340,54 @@ func decodeRow_16or32(d *decoder, buf []byte, j int) error {
 }
 
 func decodeRow_24(d *decoder, buf []byte, j int) error {
+	dst := d.img_NRGBA.Pix[j*d.img_NRGBA.Stride : j*d.img_NRGBA.Stride+4*d.width]
 	for i := 0; i < d.width; i++ {
-		for k := 0; k < 3; k++ {
-			d.img_NRGBA.Pix[j*d.img_NRGBA.Stride+i*4+k] = buf[i*3+2-k]
-		}
-		d.img_NRGBA.Pix[j*d.img_NRGBA.Stride+i*4+3] = 255
+		dst[i*4] = buf[i*3+2]
+		dst[i*4+1] = buf[i*3+1]
+		dst[i*4+2] = buf[i*3]
+		dst[i*4+3] = 255
 	}
 	return nil
 }
 
 type decodeRowFuncType func(d *decoder, buf []byte, j int) error
 
-var rowDecoders = map[int]decodeRowFuncType{
-	1:  decodeRow_paletted,
-	2:  decodeRow_paletted,
-	4:  decodeRow_paletted,
-	8:  decodeRow_paletted,
-	16: decodeRow_16or32,
-	24: decodeRow_24,
-	32: decodeRow_16or32,
+// Prepares any lookup tables needed to decode the rows of an uncompressed
+// image, and returns the function to use. Returns nil if the bit count is
+// not supported.
+func (d *decoder) selectRowDecoder() decodeRowFuncType {
+	switch d.bitCount {
+	case 1:
+		d.makePalMap()
+		return decodeRow_1
+	case 2:
+		d.makePalMap()
+		return decodeRow_2
+	case 4:
+		d.makePalMap()
+		return decodeRow_4
+	case 8:
+		d.makePalMap()
+		return decodeRow_8
+	case 16:
+		if d.makeChannelTables() {
+			return decodeRow_16
+		}
+		return decodeRow_16or32
+	case 24:
+		return decodeRow_24
+	case 32:
+		if d.bitFields[0].mask == 0x00ff0000 && d.bitFields[1].mask == 0x0000ff00 &&
+			d.bitFields[2].mask == 0x000000ff &&
+			(d.bitFields[3].mask == 0xff000000 || d.bitFields[3].mask == 0) {
+			return decodeRow_32BGRA
+		}
+		if d.makeChannelTables() {
+			return decodeRow_32
+		}
+		return decodeRow_16or32
+	}
+	return nil
 }
 
 func (d *decoder) readBitsUncompressed() error {
@@ -152,11 +396,16 @@ func (d *decoder) readBitsUncompressed() error {
 	srcRowStride := ((d.width*d.bitCount + 31) / 32) * 4
 	buf := make([]byte, srcRowStride)
 
-	decodeRowFunc := rowDecoders[d.bitCount]
+	decodeRowFunc := d.selectRowDecoder()
 	if decodeRowFunc == nil {
 		return nil
 	}
 
+	workers := numWorkers(d.opts.concurrency)
+	if workers > 1 {
+		return d.readBitsUncompressedParallel(decodeRowFunc, srcRowStride, workers)
+	}
+
 	for srcRow := 0; srcRow < d.height; srcRow++ {
 		var dstRow int
 
@@ -174,10 +423,62 @@ func (d *decoder) readBitsUncompressed() error {
 		if err != nil {
 			return err
 		}
+		err = d.rowsDone(srcRow + 1)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Reads many rows at a time, and decodes them using multiple goroutines.
+func (d *decoder) readBitsUncompressedParallel(decodeRowFunc decodeRowFuncType,
+	srcRowStride int, workers int) error {
+	var err error
+
+	chunkRows := rowsPerChunk(workers, srcRowStride, d.height)
+	buf := make([]byte, chunkRows*srcRowStride)
+
+	for startRow := 0; startRow < d.height; startRow += chunkRows {
+		numRows := chunkRows
+		if startRow+numRows > d.height {
+			numRows = d.height - startRow
+		}
+
+		_, err = io.ReadFull(d.r, buf[:numRows*srcRowStride])
+		if err != nil {
+			return err
+		}
+
+		err = parallelRows(numRows, workers, func(w, k int) error {
+			srcRow := startRow + k
+			dstRow := srcRow
+			if !d.isTopDown {
+				dstRow = d.height - srcRow - 1
+			}
+			return decodeRowFunc(d, buf[k*srcRowStride:(k+1)*srcRowStride], dstRow)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = d.rowsDone(startRow + numRows)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Called after each row (or group of rows) is decoded. Reports progress, and
+// returns an error if the operation has been canceled.
+func (d *decoder) rowsDone(n int) error {
+	if d.opts.progressFn != nil {
+		d.opts.progressFn(n, d.height)
+	}
+	return d.ctx.Err()
+}
+
 func (d *decoder) skipBytes(n int) error {
 	var buf [1024]byte
 
@@ -195,16 +496,22 @@ func (d *decoder) skipBytes(n int) error {
 	return nil
 }
 
+// Returns the number of unused bytes between the end of the palette and the
+// start of the bitmap bits. A negative number means bfOffBits is too small.
+func (d *decoder) gapSize() int {
+	currentOffset := 14 + int(d.headerSize) + d.bitFieldsSegmentSize + d.srcPalSizeInBytes
+	return int(d.bfOffBits) - currentOffset
+}
+
 // If there is a gap before the bits, skip over it.
 func (d *decoder) readGap() error {
-	currentOffset := 14 + int(d.headerSize) + d.bitFieldsSegmentSize + d.srcPalSizeInBytes
-	if currentOffset == int(d.bfOffBits) {
+	gapSize := d.gapSize()
+	if gapSize == 0 {
 		return nil
 	}
-	if currentOffset > int(d.bfOffBits) {
+	if gapSize < 0 {
 		return FormatError("bad bfOffBits field")
 	}
-	gapSize := int(d.bfOffBits) - currentOffset
 
 	return d.skipBytes(gapSize)
 }
@@ -213,6 +520,7 @@ func (d *decoder) readGap() error {
 func decodeInfoHeader12(d *decoder, h []byte, configOnly bool) error {
 	d.width = int(getWORD(h[4:6]))
 	d.height = int(getWORD(h[6:8]))
+	d.planes = int(getWORD(h[8:10]))
 	d.bitCount = int(getWORD(h[10:12]))
 	d.srcPalBytesPerEntry = 3
 	if d.bitCount >= 1 && d.bitCount <= 8 {
@@ -241,6 +549,7 @@ func decodeInfoHeader40(d *decoder, h []byte, configOnly bool) error {
 		d.isTopDown = true
 		d.height = -d.height
 	}
+	d.planes = int(getWORD(h[12:14]))
 	d.bitCount = int(getWORD(h[14:16]))
 	if configOnly {
 		return nil
@@ -253,6 +562,9 @@ func decodeInfoHeader40(d *decoder, h []byte, configOnly bool) error {
 	if d.biCompression == bI_BITFIELDS && d.headerSize == 40 && d.bitCount != 1 {
 		d.hasBitFieldsSegment = true
 		d.bitFieldsSegmentSize = 12
+	} else if d.biCompression == bI_ALPHABITFIELDS && d.headerSize == 40 {
+		d.hasBitFieldsSegment = true
+		d.bitFieldsSegmentSize = 16
 	}
 
 	if d.biCompression == bI_RGB {
@@ -265,10 +577,20 @@ func decodeInfoHeader40(d *decoder, h []byte, configOnly bool) error {
 		}
 	}
 
-	var biClrUsed uint32
+	if len(h) >= 24 {
+		d.biSizeImage = getDWORD(h[20:24])
+	}
+	if len(h) >= 32 {
+		d.xPelsPerMeter = int32(getDWORD(h[24:28]))
+		d.yPelsPerMeter = int32(getDWORD(h[28:32]))
+	}
 	if len(h) >= 36 {
-		biClrUsed = getDWORD(h[32:36])
+		d.biClrUsed = getDWORD(h[32:36])
+	}
+	if len(h) >= 40 {
+		d.biClrImportant = getDWORD(h[36:40])
 	}
+	biClrUsed := d.biClrUsed
 	if biClrUsed > 10000 {
 		return FormatError(fmt.Sprintf("bad palette size %d", biClrUsed))
 	}
@@ -305,13 +627,31 @@ func decodeInfoHeader108(d *decoder, h []byte, configOnly bool) error {
 		return err
 	}
 
-	if d.biCompression == bI_BITFIELDS {
+	if d.biCompression == bI_BITFIELDS || d.biCompression == bI_ALPHABITFIELDS {
 		var bf_alpha uint32
 		if len(h) >= 56 {
 			bf_alpha = getDWORD(h[52:56])
 		}
-		d.recordBitFields(getDWORD(h[40:44]), getDWORD(h[44:48]),
+		err = d.recordBitFields(getDWORD(h[40:44]), getDWORD(h[44:48]),
 			getDWORD(h[48:52]), bf_alpha)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(h) >= 108 {
+		d.csType = getDWORD(h[56:60])
+		for k := 0; k < 9; k++ {
+			d.endpoints[k] = getDWORD(h[60+4*k : 64+4*k])
+		}
+		for k := 0; k < 3; k++ {
+			d.gamma[k] = getDWORD(h[96+4*k : 100+4*k])
+		}
+	}
+	if len(h) >= 124 {
+		d.intent = getDWORD(h[108:112])
+		d.profileData = getDWORD(h[112:116])
+		d.profileSize = getDWORD(h[116:120])
 	}
 	return nil
 }
@@ -361,14 +701,21 @@ func readInfoHeader(d *decoder, configOnly bool) error {
 	return nil
 }
 
-func (d *decoder) recordBitFields(r, g, b, a uint32) {
+func (d *decoder) recordBitFields(r, g, b, a uint32) error {
 	d.bitFields[0].mask = r
 	d.bitFields[1].mask = g
 	d.bitFields[2].mask = b
 	d.bitFields[3].mask = a
 
+	// The masks must not overlap.
+	if r&g != 0 || r&b != 0 || r&a != 0 || g&b != 0 || g&a != 0 || b&a != 0 {
+		return FormatError("overlapping bitfields masks")
+	}
+
 	// Based on .mask, set the other fields of the bitFields struct
 	for k := 0; k < 4; k++ {
+		d.bitFields[k].shift = 0
+		d.bitFields[k].scale = 0
 		if d.bitFields[k].mask == 0 {
 			continue
 		}
@@ -380,8 +727,14 @@ func (d *decoder) recordBitFields(r, g, b, a uint32) {
 			d.bitFields[k].shift++
 			tmpMask >>= 1
 		}
+		// The 1 bits must be contiguous.
+		if tmpMask&(tmpMask+1) != 0 {
+			return FormatError(fmt.Sprintf("noncontiguous bitfields mask 0x%08x",
+				d.bitFields[k].mask))
+		}
 		d.bitFields[k].scale = 255.0 / float64(tmpMask)
 	}
+	return nil
 }
 
 func (d *decoder) readBitFieldsSegment() error {
@@ -390,9 +743,12 @@ func (d *decoder) readBitFieldsSegment() error {
 	if err != nil {
 		return err
 	}
-	d.recordBitFields(getDWORD(buf[0:4]), getDWORD(buf[4:8]),
-		getDWORD(buf[8:12]), 0)
-	return nil
+	var bf_alpha uint32
+	if d.bitFieldsSegmentSize >= 16 {
+		bf_alpha = getDWORD(buf[12:16])
+	}
+	return d.recordBitFields(getDWORD(buf[0:4]), getDWORD(buf[4:8]),
+		getDWORD(buf[8:12]), bf_alpha)
 }
 
 func (d *decoder) readPalette() error {
@@ -414,6 +770,25 @@ func (d *decoder) readPalette() error {
 	}
 
 	d.dstPalette = make(color.Palette, d.dstPalNumEntries)
+
+	if d.opts.paletteAlpha && d.srcPalBytesPerEntry == 4 {
+		// If every alpha byte is 0, assume the field is unused, and that the
+		// palette is opaque.
+		hasAlpha := false
+		for i := 0; i < d.dstPalNumEntries; i++ {
+			if buf[i*4+3] != 0 {
+				hasAlpha = true
+				break
+			}
+		}
+		if hasAlpha {
+			for i := 0; i < d.dstPalNumEntries; i++ {
+				d.dstPalette[i] = color.NRGBA{buf[i*4+2], buf[i*4+1], buf[i*4+0], buf[i*4+3]}
+			}
+			return nil
+		}
+	}
+
 	for i := 0; i < d.dstPalNumEntries; i++ {
 		d.dstPalette[i] = color.RGBA{buf[i*d.srcPalBytesPerEntry+2],
 			buf[i*d.srcPalBytesPerEntry+1],
@@ -426,6 +801,7 @@ func (d *decoder) decodeFileHeader(b []byte) error {
 	if b[0] != 0x42 || b[1] != 0x4d {
 		return FormatError("not a BMP file")
 	}
+	d.bfSize = getDWORD(b[2:6])
 	d.bfOffBits = getDWORD(b[10:14])
 	return nil
 }
@@ -487,6 +863,10 @@ func (d *decoder) readMain(r io.Reader, configOnly bool) (image.Image, error) {
 		} else if d.bitCount != 16 && d.bitCount != 32 {
 			return nil, FormatError(fmt.Sprintf("bad BITFIELDS bit count %d", d.bitCount))
 		}
+	case bI_ALPHABITFIELDS:
+		if d.bitCount != 16 && d.bitCount != 32 {
+			return nil, FormatError(fmt.Sprintf("bad ALPHABITFIELDS bit count %d", d.bitCount))
+		}
 	default:
 		return nil, UnsupportedError(fmt.Sprintf("compression or image type %d", d.biCompression))
 	}
@@ -546,17 +926,36 @@ func (d *decoder) readMain(r io.Reader, configOnly bool) (image.Image, error) {
 	return d.img_NRGBA, nil
 }
 
-// Decode reads a BMP image from r and returns it as an image.Image.
-func Decode(r io.Reader) (image.Image, error) {
+// DecodeWithOptions reads a BMP image from r and returns it as an
+// image.Image, using the options recorded in opts.
+// opts may be nil, in which case it behaves the same as Decode.
+func DecodeWithOptions(r io.Reader, opts *DecoderOptions) (image.Image, error) {
+	return DecodeContext(context.Background(), r, opts)
+}
+
+// DecodeContext is like DecodeWithOptions, but stops decoding and returns
+// ctx.Err() if ctx is canceled before the image has been completely decoded.
+func DecodeContext(ctx context.Context, r io.Reader, opts *DecoderOptions) (image.Image, error) {
 	var err error
 
 	d := new(decoder)
 	d.r = r
+	d.ctx = ctx
+	if opts != nil {
+		d.opts = opts
+	} else {
+		d.opts = new(DecoderOptions)
+	}
 
 	im, err := d.readMain(r, false)
 	return im, err
 }
 
+// Decode reads a BMP image from r and returns it as an image.Image.
+func Decode(r io.Reader) (image.Image, error) {
+	return DecodeWithOptions(r, nil)
+}
+
 // DecodeConfig returns the color model and dimensions of the BMP image without
 // decoding the entire image.
 func DecodeConfig(r io.Reader) (image.Config, error) {
@@ -565,6 +964,8 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 
 	d := new(decoder)
 	d.r = r
+	d.opts = new(DecoderOptions)
+	d.ctx = context.Background()
 
 	_, err = d.readMain(r, true)
 	if err != nil {
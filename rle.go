@@ -3,7 +3,7 @@
 // Use of this code is governed by an MIT-style license that can
 // be found in the readme.md file.
 //
-// BMP RLE decoder
+// BMP RLE decoder and encoder
 //
 
 package gobmp
@@ -12,23 +12,16 @@ import "io"
 import "bufio"
 
 type rleState struct {
-	xpos, ypos   int // Position in the target image
-	badColorFlag bool
+	xpos, ypos int // Position in the target image
 }
 
-func (d *decoder) rlePutPixel(rle *rleState, v byte) {
-	// Make sure the position is valid.
-	if rle.xpos < 0 || rle.xpos >= d.width ||
-		rle.ypos < 0 || rle.ypos >= d.height {
-		return
-	}
-	// Make sure the palette index is valid.
-	if int(v) >= d.dstPalNumEntries {
-		rle.badColorFlag = true
-		return
+// Returns the target image row corresponding to rle.ypos, or nil if rle.ypos
+// is out of bounds.
+func (d *decoder) rleRow(rle *rleState) []byte {
+	if rle.ypos < 0 || rle.ypos >= d.height {
+		return nil
 	}
 
-	// Set the pixel, and advance the current position.
 	var dstRow int
 
 	if d.isTopDown {
@@ -39,16 +32,88 @@ func (d *decoder) rlePutPixel(rle *rleState, v byte) {
 		dstRow = d.height - rle.ypos - 1
 	}
 
-	d.img_Paletted.Pix[dstRow*d.img_Paletted.Stride+rle.xpos] = v
-	rle.xpos++
+	return d.img_Paletted.Pix[dstRow*d.img_Paletted.Stride : dstRow*d.img_Paletted.Stride+d.width]
+}
+
+// Returns the number of the n pixels starting at the current position that
+// are within the image. Pixels that would be past the end of the row are
+// discarded, and do not advance the current position.
+func (d *decoder) rleClip(rle *rleState, n int) int {
+	if rle.ypos < 0 || rle.ypos >= d.height || rle.xpos >= d.width {
+		return 0
+	}
+	if n > d.width-rle.xpos {
+		n = d.width - rle.xpos
+	}
+	return n
+}
+
+// Write a compressed run of n pixels, alternating between colors v1 and v2.
+// (For RLE8, v1 and v2 are the same.)
+func (d *decoder) rlePutRun(rle *rleState, n int, v1, v2 byte) error {
+	n = d.rleClip(rle, n)
+	if n < 1 {
+		return nil
+	}
+	if int(v1) >= d.dstPalNumEntries || (n > 1 && int(v2) >= d.dstPalNumEntries) {
+		return FormatError("palette index out of range")
+	}
+
+	dst := d.rleRow(rle)[rle.xpos : rle.xpos+n]
+	dst[0] = v1
+	if n > 1 {
+		dst[1] = v2
+	}
+	// Fill the rest of the span by repeatedly doubling the filled part.
+	for filled := 2; filled < n; filled *= 2 {
+		copy(dst[filled:], dst[:filled])
+	}
+	rle.xpos += n
+	return nil
+}
+
+// Write an uncompressed run of n pixels, taken from the (RLE4 or RLE8) data
+// in src.
+func (d *decoder) rlePutUncompressed(rle *rleState, n int, src []byte) error {
+	n = d.rleClip(rle, n)
+	if n < 1 {
+		return nil
+	}
+
+	// Make sure the palette indices are valid.
+	if d.dstPalNumEntries < 1<<uint(d.bitCount) {
+		for i := 0; i < n; i++ {
+			v := src[i]
+			if d.biCompression == bI_RLE4 {
+				v = unpackTable4[src[i/2]][i%2]
+			}
+			if int(v) >= d.dstPalNumEntries {
+				return FormatError("palette index out of range")
+			}
+		}
+	}
+
+	dst := d.rleRow(rle)[rle.xpos : rle.xpos+n]
+	if d.biCompression == bI_RLE4 {
+		for i := 0; i < n-1; i += 2 {
+			t := &unpackTable4[src[i/2]]
+			dst[i] = t[0]
+			dst[i+1] = t[1]
+		}
+		if n%2 != 0 {
+			dst[n-1] = unpackTable4[src[n/2]][0]
+		}
+	} else {
+		copy(dst, src)
+	}
+	rle.xpos += n
+	return nil
 }
 
 func (d *decoder) readBitsRLE() error {
 	var err error
 	var b1, b2 byte
-	var uncPixelsLeft int
-	var deltaFlag bool
-	var k int
+	var uncBuf [256]byte
 
 	bufferedR := bufio.NewReader(d.r)
 	rle := new(rleState)
@@ -56,10 +121,6 @@ func (d *decoder) readBitsRLE() error {
 	rle.ypos = 0
 
 	for {
-		if rle.badColorFlag {
-			return FormatError("palette index out of range")
-		}
-
 		if rle.ypos >= d.height || (rle.ypos == (d.height-1) && rle.xpos >= d.width) {
 			break // Reached the end of the target image; may as well stop
 		}
@@ -76,37 +137,7 @@ func (d *decoder) readBitsRLE() error {
 			return err
 		}
 
-		if uncPixelsLeft > 0 {
-			if d.biCompression == bI_RLE4 {
-				// The two bytes we're processing store up to 4 uncompressed pixels.
-				d.rlePutPixel(rle, b1>>4)
-				uncPixelsLeft--
-				if uncPixelsLeft > 0 {
-					d.rlePutPixel(rle, b1&0x0f)
-					uncPixelsLeft--
-				}
-				if uncPixelsLeft > 0 {
-					d.rlePutPixel(rle, b2>>4)
-					uncPixelsLeft--
-				}
-				if uncPixelsLeft > 0 {
-					d.rlePutPixel(rle, b2&0x0f)
-					uncPixelsLeft--
-				}
-			} else { // RLE8
-				// The two bytes we're processing store up to 2 uncompressed pixels.
-				d.rlePutPixel(rle, b1)
-				uncPixelsLeft--
-				if uncPixelsLeft > 0 {
-					d.rlePutPixel(rle, b2)
-					uncPixelsLeft--
-				}
-			}
-		} else if deltaFlag {
-			rle.xpos += int(b1)
-			rle.ypos += int(b2)
-			deltaFlag = false
-		} else if b1 == 0 {
+		if b1 == 0 {
 			// An uncompressed run, or a special code.
 			//
 			// Any pixels skipped by special codes will be left at whatever
@@ -115,32 +146,295 @@ func (d *decoder) readBitsRLE() error {
 			if b2 == 0 { // End of row
 				rle.ypos++
 				rle.xpos = 0
+				err = d.rleRowsDone(rle)
+				if err != nil {
+					return err
+				}
 			} else if b2 == 1 { // End of bitmap
 				break
 			} else if b2 == 2 { // Delta
-				deltaFlag = true
+				b1, err = bufferedR.ReadByte()
+				if err == nil {
+					b2, err = bufferedR.ReadByte()
+				}
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					return err
+				}
+				rle.xpos += int(b1)
+				rle.ypos += int(b2)
+				if b2 != 0 {
+					err = d.rleRowsDone(rle)
+					if err != nil {
+						return err
+					}
+				}
 			} else {
-				// An upcoming uncompressed run of b2 pixels
-				uncPixelsLeft = int(b2)
+				// An uncompressed run of b2 pixels, padded to a multiple of
+				// 2 bytes.
+				n := int(b2)
+				var nBytes int
+				if d.biCompression == bI_RLE4 {
+					nBytes = ((n + 3) / 4) * 2
+				} else {
+					nBytes = ((n + 1) / 2) * 2
+				}
+				nRead, err := io.ReadFull(bufferedR, uncBuf[:nBytes])
+				if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+					return err
+				}
+				if nRead < nBytes {
+					// The data ends in the middle of the run. Use whatever
+					// complete 2-byte units are present.
+					nRead &^= 1
+					if d.biCompression == bI_RLE4 {
+						n = 2 * nRead
+					} else {
+						n = nRead
+					}
+				}
+				err = d.rlePutUncompressed(rle, n, uncBuf[:])
+				if err != nil {
+					return err
+				}
+				if nRead < nBytes {
+					break
+				}
 			}
 		} else { // A compressed run of pixels
 			if d.biCompression == bI_RLE4 {
 				// b1 pixels, alternating between two colors
-				for k = 0; k < int(b1); k++ {
-					if k%2 == 0 {
-						d.rlePutPixel(rle, b2>>4)
-					} else {
-						d.rlePutPixel(rle, b2&0x0f)
-					}
-				}
+				err = d.rlePutRun(rle, int(b1), b2>>4, b2&0x0f)
 			} else { // RLE8
 				// b1 pixels of color b2
-				for k = 0; k < int(b1); k++ {
-					d.rlePutPixel(rle, b2)
-				}
+				err = d.rlePutRun(rle, int(b1), b2, b2)
+			}
+			if err != nil {
+				return err
 			}
 		}
 	}
 
+	if rle.ypos < d.height {
+		// Any remaining rows are left blank, and are considered to be done.
+		rle.ypos = d.height
+		err = d.rleRowsDone(rle)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// Called when rle.ypos has advanced.
+func (d *decoder) rleRowsDone(rle *rleState) error {
+	if rle.ypos > d.height {
+		return d.rowsDone(d.height)
+	}
+	return d.rowsDone(rle.ypos)
+}
+
+// Returns the number of pixels, up to max, in the run of identical pixels
+// starting at row[i].
+func rleRunLength8(row []byte, i int, max int) int {
+	n := 1
+	for i+n < len(row) && n < max && row[i+n] == row[i] {
+		n++
+	}
+	return n
+}
+
+// Returns the number of pixels, up to max, in the run starting at row[i] in
+// which the pixels alternate between two colors.
+func rleRunLength4(row []byte, i int, max int) int {
+	n := 1
+	for i+n < len(row) && n < max && row[i+n] == row[i+n%2] {
+		n++
+	}
+	return n
+}
+
+// Append an uncompressed run of 8-bit pixels to dst.
+func rleWriteAbsolute8(dst []byte, px []byte) []byte {
+	if len(px) < 3 {
+		// Too short for an uncompressed run; use compressed runs.
+		for i := 0; i < len(px); i++ {
+			dst = append(dst, 1, px[i])
+		}
+		return dst
+	}
+	dst = append(dst, 0, byte(len(px)))
+	dst = append(dst, px...)
+	if len(px)%2 != 0 {
+		dst = append(dst, 0) // Pad to a multiple of 2 bytes
+	}
+	return dst
+}
+
+// Append an uncompressed run of 4-bit pixels to dst.
+func rleWriteAbsolute4(dst []byte, px []byte) []byte {
+	if len(px) < 3 {
+		// Too short for an uncompressed run; use a compressed run.
+		if len(px) == 1 {
+			return append(dst, 1, px[0]<<4)
+		}
+		return append(dst, 2, px[0]<<4|px[1])
+	}
+	dst = append(dst, 0, byte(len(px)))
+	for i := 0; i < len(px); i += 2 {
+		v := px[i] << 4
+		if i+1 < len(px) {
+			v |= px[i+1]
+		}
+		dst = append(dst, v)
+	}
+	if (len(px)+1)/2%2 != 0 {
+		dst = append(dst, 0) // Pad to a multiple of 2 bytes
+	}
+	return dst
+}
+
+// Compress a row of palette indices using RLE8, and append it to dst.
+// Runs of at least minRun identical pixels are written as compressed runs;
+// other pixels are written as uncompressed runs.
+func rleCompressRow8(dst []byte, row []byte) []byte {
+	const minRun = 3
+	i := 0
+	for i < len(row) {
+		n := rleRunLength8(row, i, 255)
+		if n >= minRun {
+			dst = append(dst, byte(n), row[i])
+			i += n
+			continue
+		}
+
+		// Collect pixels until the next long run.
+		j := i + 1
+		for j < len(row) && j-i < 255 && rleRunLength8(row, j, minRun) < minRun {
+			j++
+		}
+		dst = rleWriteAbsolute8(dst, row[i:j])
+		i = j
+	}
+	return dst
+}
+
+// Compress a row of palette indices (each less than 16) using RLE4, and
+// append it to dst.
+func rleCompressRow4(dst []byte, row []byte) []byte {
+	const minRun = 4
+	i := 0
+	for i < len(row) {
+		n := rleRunLength4(row, i, 255)
+		if n >= minRun {
+			v := row[i] << 4
+			if n > 1 {
+				v |= row[i+1]
+			}
+			dst = append(dst, byte(n), v)
+			i += n
+			continue
+		}
+
+		// Collect pixels until the next long run.
+		j := i + 1
+		for j < len(row) && j-i < 255 && rleRunLength4(row, j, minRun) < minRun {
+			j++
+		}
+		dst = rleWriteAbsolute4(dst, row[i:j])
+		i = j
+	}
+	return dst
+}
+
+// Compress a row of palette indices, in which the pixels whose indices are
+// flagged in e.rleTrns are transparent, and append it to dst. Transparent
+// pixels are skipped using delta codes, except for those at the end of the
+// row, which the caller is expected to skip with an end-of-row code.
+// Returns the new dst, and whether the row contains any non-transparent
+// pixels.
+func (e *encoder) rleCompressRowTrns(dst []byte, compression uint32, row []byte) ([]byte, bool) {
+	end := len(row)
+	for end > 0 && e.rleTrns[row[end-1]] {
+		end--
+	}
+
+	i := 0
+	for i < end {
+		j := i + 1
+		if e.rleTrns[row[i]] {
+			for j < end && e.rleTrns[row[j]] {
+				j++
+			}
+			for n := j - i; n > 0; n -= 255 {
+				dx := n
+				if dx > 255 {
+					dx = 255
+				}
+				dst = append(dst, 0, 2, byte(dx), 0) // Delta
+			}
+		} else {
+			for j < end && !e.rleTrns[row[j]] {
+				j++
+			}
+			if compression == bI_RLE4 {
+				dst = rleCompressRow4(dst, row[i:j])
+			} else {
+				dst = rleCompressRow8(dst, row[i:j])
+			}
+		}
+		i = j
+	}
+	return dst, end > 0
+}
+
+// Compress the image using RLE4 or RLE8 (according to the compression
+// parameter), and return the compressed bits.
+func (e *encoder) compressRLE(compression uint32) ([]byte, error) {
+	var err error
+	var genRowFunc func(e *encoder, j int, rowBuf []byte)
+
+	// Generate rows with one palette index per byte.
+	if e.srcIsGray {
+		genRowFunc = generateRow_GrayPal
+	} else {
+		genRowFunc = generateRow_8
+	}
+
+	rowBuf := make([]byte, e.width)
+	var bits []byte
+	contentEnd := 0 // The size of bits after the last row with content
+
+	for j := 0; j < e.height; j++ {
+		genRowFunc(e, e.height-j-1, rowBuf)
+		hasContent := true
+		if e.rleSkipTrns {
+			bits, hasContent = e.rleCompressRowTrns(bits, compression, rowBuf)
+		} else if compression == bI_RLE4 {
+			bits = rleCompressRow4(bits, rowBuf)
+		} else {
+			bits = rleCompressRow8(bits, rowBuf)
+		}
+		if hasContent {
+			contentEnd = len(bits)
+		}
+
+		if j < e.height-1 {
+			bits = append(bits, 0, 0) // End of row
+		}
+
+		// Progress is reported when the bits are written, but we should still
+		// stop if canceled.
+		err = e.ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// If the last rows are entirely transparent, there's no need to write
+	// end-of-row codes for them.
+	bits = append(bits[:contentEnd], 0, 1) // End of bitmap
+	return bits, nil
+}
@@ -8,15 +8,44 @@
 
 package gobmp
 
+import "context"
 import "image"
+import "image/draw"
 import "io"
+import "fmt"
 
 // EncoderOptions stores options that can be passed to EncodeWithOptions().
 // Create an EncoderOptions object with new().
 type EncoderOptions struct {
-	densitySet   bool
-	xDens, yDens int
-	supportTrns  bool
+	densitySet     bool
+	xDens, yDens   int
+	supportTrns    bool
+	progressFn     func(rowsDone, rowsTotal int)
+	concurrency    int
+	rle            bool
+	smallest       bool
+	rleTrns        bool
+	format16       Format16
+	dither         DitherMode
+	alphaDither    DitherMode
+	alphaThreshSet bool
+	alphaThresh    uint8
+	alphaBitFields bool
+	bitCount       int
+	quantize       bool
+	quantizer      draw.Quantizer
+	drawer         draw.Drawer
+	headerType     HeaderType
+	topDown        bool
+	iccProfile     []byte
+	linkedProfile  string
+	intent         Intent
+	calibrated     *CalibratedRGB
+	support2Bit    bool
+	autoPalette    bool
+	trimPalette    bool
+	paletteOrder   PaletteOrder
+	paletteAlpha   bool
 }
 
 // SetDensity sets the density to write to the output image's metadata, in
@@ -34,26 +63,143 @@ func (opts *EncoderOptions) SupportTransparency(t bool) {
 	opts.supportTrns = t
 }
 
+// SetHeaderType sets the version of the info header to write: HeaderCore,
+// HeaderInfo, HeaderV2, HeaderV3, HeaderV4, or HeaderV5. The default, 0,
+// means to use HeaderInfo, unless a BITMAPV5HEADER is needed for
+// transparency. An error is returned if the image can't be written with the
+// requested header.
+//
+// HeaderCore writes an OS/2 1.x file, which has 3-byte palette entries. Its
+// width and height can't exceed 65535, and its bit count must be 1, 4, 8, or
+// 24.
+func (opts *EncoderOptions) SetHeaderType(h HeaderType) {
+	opts.headerType = h
+}
+
+// SetTopDown causes the image to be written in top-down order, with a
+// negative height. It can't be used with RLE compression or a
+// BITMAPCOREHEADER. With SetSmallest, it restricts the output to
+// uncompressed images.
+func (opts *EncoderOptions) SetTopDown(b bool) {
+	opts.topDown = b
+}
+
+// Support2Bit allows 2-bit paletted images (a Windows CE format) to be written
+// when the image has 3 or 4 colors. Many applications can't read them.
+// The default is false, in which case such images are written with 4 bits per
+// pixel.
+func (opts *EncoderOptions) Support2Bit(b bool) {
+	opts.support2Bit = b
+}
+
+// SetAutoPalette causes images that would otherwise be written in 24-bit
+// format to be written as 1-, 4-, or 8-bit paletted images, if they have
+// no more than 256 distinct colors. Images whose colors are all gray use a
+// grayscale palette. This requires examining every pixel before writing
+// the image.
+func (opts *EncoderOptions) SetAutoPalette(b bool) {
+	opts.autoPalette = b
+}
+
+// SetBitCount sets the number of bits per pixel to write: 1, 2, 4, 8, 16, 24,
+// or 32. The default, 0, means to choose automatically. The image will be
+// converted as needed. An error is returned if the image has too many colors
+// to be written with the requested bit count.
+//
+// Images with 16 bits per pixel are written in RGB555 format, unless a format
+// is set with Set16Bit. Images with 1 to 24 bits per pixel never include
+// transparency.
+func (opts *EncoderOptions) SetBitCount(n int) {
+	opts.bitCount = n
+}
+
+// SetProgressFunc sets a function to be called periodically while the image
+// bits are being written, to report how many rows have been written so far.
+func (opts *EncoderOptions) SetProgressFunc(f func(rowsDone, rowsTotal int)) {
+	opts.progressFn = f
+}
+
+// SetConcurrency sets the number of goroutines to use when generating the
+// image bits. The default, 0 (or 1), does all work in the calling goroutine.
+// A negative value means to use runtime.GOMAXPROCS(0) goroutines.
+// Using more than one goroutine increases memory usage.
+func (opts *EncoderOptions) SetConcurrency(n int) {
+	opts.concurrency = n
+}
+
+// SetRLE indicates whether to compress paletted images, using RLE8 for
+// 8-bit images, and RLE4 for images that would otherwise be written with 4
+// or fewer bits per pixel. Images that are not written as paletted images
+// are not affected.
+func (opts *EncoderOptions) SetRLE(rle bool) {
+	opts.rle = rle
+}
+
+// SetSmallest indicates whether to try each of the available ways of
+// writing the image, and use the one that results in the smallest file.
+// Currently, this only affects paletted images, which may be written
+// uncompressed or with RLE compression. If enabled, SetRLE is ignored.
+func (opts *EncoderOptions) SetSmallest(s bool) {
+	opts.smallest = s
+}
+
+// SetRLETransparency indicates whether to retain transparency in paletted
+// images by writing an RLE-compressed image in which transparent pixels are
+// skipped, instead of being assigned a color. This applies to *image.Paletted
+// images whose palette contains a fully transparent color, and overrides
+// SupportTransparency for such images. Transparency is lost if the image has
+// to be quantized. Many BMP readers do not support skipped pixels, or display
+// them using the first palette color.
+func (opts *EncoderOptions) SetRLETransparency(t bool) {
+	opts.rleTrns = t
+}
+
 type encoder struct {
 	opts         *EncoderOptions
+	ctx          context.Context
 	w            io.Writer
 	m            image.Image
 	m_AsPaletted *image.Paletted
 
-	srcBounds     image.Rectangle
-	width         int
-	height        int
-	dstStride     int
-	dstBitsSize   int
-	dstBitCount   int
-	dstBitsOffset int
-	dstFileSize   int
+	srcBounds      image.Rectangle
+	width          int
+	height         int
+	dstStride      int
+	dstBitsSize    int
+	dstBitCount    int
+	dstCompression uint32
+	dstBitsOffset  int
+	dstFileSize    int
 
 	writeAlpha    bool
 	writePaletted bool
 	srcIsGray     bool
-	nColors       int // Number of colors in palette; 0 if no palette
-	headerSize    int // 40 (for BMPv3) or 124 (for BMPv5)
+	nColors       int  // Number of colors in palette; 0 if no palette
+	palAlpha      bool // Whether to write alpha values in the palette
+	palNumEntries int  // Number of palette entries to write; may exceed nColors
+	palEntrySize  int  // Bytes per palette entry: 3 or 4
+	headerSize    int  // The size of the info header
+	bitCount      int  // The requested bit count, or 0
+
+	palBGRA [256][4]byte // See makePalBGRA
+
+	rleSkipTrns bool      // Whether to skip transparent pixels using RLE codes
+	rleTrns     [256]bool // The palette entries that are transparent
+	rleBits     []byte    // The compressed image, if dstCompression is RLE
+
+	dstMasks             [4]uint32 // Red, green, blue, and alpha masks
+	bitFieldsSegmentSize int       // 12 or 16 if masks follow a 40-byte header
+	chan16               [4]chan16Info
+	fsErrCur, fsErrNext  [4][]int32 // Floyd-Steinberg error for each channel
+	alphaThresh          uint8      // Smallest alpha value written as opaque
+	rowScratch           []byte     // Source row buffer for generateRow_16
+
+	forIcon bool // Whether this is an image in an ICO or CUR file
+
+	csType    uint32
+	endpoints [9]uint32 // For calibrated RGB; see Info.Endpoints
+	gamma     [3]uint32
+	profile   []byte // Embedded profile, or linked profile filename
 }
 
 func setWORD(b []byte, n uint16) {
@@ -76,16 +222,19 @@ func (e *encoder) generateFileHeader(h []byte) {
 	setDWORD(h[10:14], uint32(e.dstBitsOffset))
 }
 
-// Write the BITMAPINFOHEADER structure to a slice[40] or [124].
+// Write the BITMAPINFOHEADER structure (or a later version of it) to a slice
+// whose size is the header size.
 func (e *encoder) generateInfoHeader(h []byte) {
 	setDWORD(h[0:4], uint32(e.headerSize))
 	setDWORD(h[4:8], uint32(e.width))
-	setDWORD(h[8:12], uint32(e.height))
+	if e.opts.topDown {
+		setDWORD(h[8:12], uint32(-e.height))
+	} else {
+		setDWORD(h[8:12], uint32(e.height))
+	}
 	setWORD(h[12:14], 1) // biPlanes
 	setWORD(h[14:16], uint16(e.dstBitCount))
-	if e.writeAlpha {
-		setWORD(h[16:20], 3) // "Compression" = BI_BITFIELDS
-	}
+	setDWORD(h[16:20], e.dstCompression)
 	setDWORD(h[20:24], uint32(e.dstBitsSize))
 	if e.opts.densitySet {
 		setDWORD(h[24:28], uint32(e.opts.xDens))
@@ -96,21 +245,66 @@ func (e *encoder) generateInfoHeader(h []byte) {
 	}
 	setDWORD(h[32:36], uint32(e.nColors))
 
-	if len(h) == 124 {
+	if len(h) >= 52 && e.dstCompression == bI_BITFIELDS {
+		setDWORD(h[40:44], e.dstMasks[0]) // RedMask
+		setDWORD(h[44:48], e.dstMasks[1]) // GreenMask
+		setDWORD(h[48:52], e.dstMasks[2]) // BlueMask
+	}
+	if len(h) >= 56 && e.dstCompression == bI_BITFIELDS {
+		setDWORD(h[52:56], e.dstMasks[3]) // AlphaMask
+	}
+	if len(h) >= 108 {
+		// Set V4 header fields
+		setDWORD(h[56:60], e.csType)
+		if e.csType == lCS_CALIBRATED_RGB {
+			for k := 0; k < 9; k++ {
+				setDWORD(h[60+4*k:64+4*k], e.endpoints[k])
+			}
+			for k := 0; k < 3; k++ {
+				setDWORD(h[96+4*k:100+4*k], e.gamma[k])
+			}
+		}
+	}
+	if len(h) >= 124 {
 		// Set V5 header fields
-		setDWORD(h[40:44], 0x00ff0000) // RedMask
-		setDWORD(h[44:48], 0x0000ff00) // GreenMask
-		setDWORD(h[48:52], 0x000000ff) // BlueMask
-		setDWORD(h[52:56], 0xff000000) // AlphaMask
-		setDWORD(h[56:60], 0x73524742) // CSType = sRGB
-		setDWORD(h[108:112], 4)        // Intent = IMAGES (perceptual)
+		intent := e.opts.intent
+		if intent == 0 {
+			intent = IntentImages
+		}
+		setDWORD(h[108:112], uint32(intent))
+		if e.profile != nil {
+			// The profile follows the bitmap bits. Its offset is measured
+			// from the start of the info header.
+			setDWORD(h[112:116], uint32(e.dstBitsOffset+e.dstBitsSize-14)) // ProfileData
+			setDWORD(h[116:120], uint32(len(e.profile)))                   // ProfileSize
+		}
 	}
 }
 
+// Write the 12-byte BITMAPCOREHEADER structure to a slice[12].
+func (e *encoder) generateCoreHeader(h []byte) {
+	setDWORD(h[0:4], uint32(e.headerSize))
+	setWORD(h[4:6], uint16(e.width))
+	setWORD(h[6:8], uint16(e.height))
+	setWORD(h[8:10], 1) // bcPlanes
+	setWORD(h[10:12], uint16(e.dstBitCount))
+}
+
 func (e *encoder) writeHeaders() error {
-	h := make([]byte, 14+e.headerSize)
+	h := make([]byte, 14+e.headerSize+e.bitFieldsSegmentSize)
 	e.generateFileHeader(h[:14])
-	e.generateInfoHeader(h[14:])
+	if e.headerSize == 12 {
+		e.generateCoreHeader(h[14 : 14+e.headerSize])
+	} else {
+		e.generateInfoHeader(h[14 : 14+e.headerSize])
+	}
+	if e.bitFieldsSegmentSize > 0 {
+		// Write the BITFIELDS (or ALPHABITFIELDS) segment
+		bf := h[14+e.headerSize:]
+		for k := 0; k < e.bitFieldsSegmentSize/4; k++ {
+			setDWORD(bf[4*k:4*k+4], e.dstMasks[k])
+		}
+	}
 	_, err := e.w.Write(h[:])
 	return err
 }
@@ -120,19 +314,23 @@ func (e *encoder) writePalette() error {
 		return nil
 	}
 
-	pal := make([]uint8, 4*e.nColors)
+	pal := make([]uint8, e.palEntrySize*e.palNumEntries)
 	for i := 0; i < e.nColors; i++ {
-		var r, g, b uint32
+		var r, g, b, a uint32
 		if e.srcIsGray {
 			// Manufacture a grayscale palette.
 			r = uint32(i) << 8
 			g, b = r, r
 		} else {
-			r, g, b, _ = e.m_AsPaletted.Palette[i].RGBA()
+			r, g, b, a = e.m_AsPaletted.Palette[i].RGBA()
+		}
+		if e.palAlpha {
+			putBGRA(pal[e.palEntrySize*i:], r, g, b, a)
+			continue
 		}
-		pal[4*i+0] = uint8(b >> 8)
-		pal[4*i+1] = uint8(g >> 8)
-		pal[4*i+2] = uint8(r >> 8)
+		pal[e.palEntrySize*i+0] = uint8(b >> 8)
+		pal[e.palEntrySize*i+1] = uint8(g >> 8)
+		pal[e.palEntrySize*i+2] = uint8(r >> 8)
 	}
 
 	_, err := e.w.Write(pal)
@@ -152,6 +350,18 @@ func generateRow_1(e *encoder, j int, rowBuf []byte) {
 	}
 }
 
+// Read a row from the (paletted) source image, and store it in rowBuf in 2-bit
+// BMP format.
+func generateRow_2(e *encoder, j int, rowBuf []byte) {
+	for i := range rowBuf {
+		rowBuf[i] = 0
+	}
+	for i := 0; i < e.width; i++ {
+		v := e.m_AsPaletted.Pix[j*e.m_AsPaletted.Stride+i]
+		rowBuf[i/4] |= v << uint(6-2*(i%4))
+	}
+}
+
 // Read a row from the (paletted) source image, and store it in rowBuf in 4-bit
 // BMP format.
 func generateRow_4(e *encoder, j int, rowBuf []byte) {
@@ -176,6 +386,18 @@ func generateRow_8(e *encoder, j int, rowBuf []byte) {
 // Read a row from the (grayscale) source image, and store it in rowBuf in
 // 8-bit BMP format.
 func generateRow_GrayPal(e *encoder, j int, rowBuf []byte) {
+	switch m := e.m.(type) {
+	case *image.Gray:
+		copy(rowBuf[0:e.width], m.Pix[m.PixOffset(e.srcBounds.Min.X, e.srcBounds.Min.Y+j):])
+		return
+	case *image.Gray16:
+		src := m.Pix[m.PixOffset(e.srcBounds.Min.X, e.srcBounds.Min.Y+j):]
+		for i := 0; i < e.width; i++ {
+			rowBuf[i] = src[i*2] // The high byte
+		}
+		return
+	}
+
 	for i := 0; i < e.width; i++ {
 		srcclr := e.m.At(e.srcBounds.Min.X+i, e.srcBounds.Min.Y+j)
 		r, _, _, _ := srcclr.RGBA()
@@ -183,34 +405,153 @@ func generateRow_GrayPal(e *encoder, j int, rowBuf []byte) {
 	}
 }
 
+// Store a color, given as 16-bit alpha-premultiplied samples as returned by
+// color.Color.RGBA(), in dst in 24-bit BMP format.
+func putBGR(dst []byte, r, g, b uint32) {
+	dst[0] = uint8(b >> 8)
+	dst[1] = uint8(g >> 8)
+	dst[2] = uint8(r >> 8)
+}
+
+// Store a color, given as 16-bit alpha-premultiplied samples as returned by
+// color.Color.RGBA(), in dst in 32-bit BMP format.
+func putBGRA(dst []byte, r, g, b, a uint32) {
+	s := [4]uint32{b, g, r, a}
+	for k := 0; k < 4; k++ {
+		if a == 0 {
+			dst[k] = 0
+		} else if k == 3 || a == 0xffff {
+			dst[k] = uint8(s[k] >> 8)
+		} else {
+			// Convert to unassociated alpha
+			dst[k] = uint8(0.5 + 255.0*(float64(s[k])/float64(a)))
+		}
+	}
+}
+
+// Convert an 8-bit unassociated-alpha sample to the 16-bit premultiplied
+// form that color.NRGBA.RGBA() would return.
+func premultiply(v uint8, a16 uint32) uint32 {
+	return uint32(v) * 0x101 * a16 / 0xffff
+}
+
+// Prepare e.palBGRA, which stores each palette color of a paletted source
+// image in 32-bit BMP format if withAlpha is true, or (in the first 3 bytes
+// of each entry) 24-bit format otherwise.
+func (e *encoder) makePalBGRA(p *image.Paletted, withAlpha bool) {
+	for i := range e.palBGRA {
+		var r, g, b, a uint32
+		if i < len(p.Palette) {
+			r, g, b, a = p.Palette[i].RGBA()
+		}
+		if withAlpha {
+			putBGRA(e.palBGRA[i][:], r, g, b, a)
+		} else {
+			putBGR(e.palBGRA[i][:], r, g, b)
+		}
+	}
+}
+
 // Read a row from the source image, and store it in rowBuf in 24-bit BMP format.
 func generateRow_24(e *encoder, j int, rowBuf []byte) {
-	var s [3]uint32
-	for i := 0; i < e.width; i++ {
-		srcclr := e.m.At(e.srcBounds.Min.X+i, e.srcBounds.Min.Y+j)
-		s[2], s[1], s[0], _ = srcclr.RGBA()
-		for k := 0; k < 3; k++ {
-			rowBuf[i*3+k] = uint8(s[k] >> 8)
+	x0 := e.srcBounds.Min.X
+	y := e.srcBounds.Min.Y + j
+
+	switch m := e.m.(type) {
+	case *image.NRGBA:
+		src := m.Pix[m.PixOffset(x0, y):]
+		for i := 0; i < e.width; i++ {
+			s := src[i*4 : i*4+4]
+			if s[3] == 0xff {
+				rowBuf[i*3], rowBuf[i*3+1], rowBuf[i*3+2] = s[2], s[1], s[0]
+			} else {
+				a := uint32(s[3]) * 0x101
+				putBGR(rowBuf[i*3:], premultiply(s[0], a), premultiply(s[1], a),
+					premultiply(s[2], a))
+			}
 		}
+		return
+	case *image.RGBA:
+		src := m.Pix[m.PixOffset(x0, y):]
+		for i := 0; i < e.width; i++ {
+			rowBuf[i*3], rowBuf[i*3+1], rowBuf[i*3+2] = src[i*4+2], src[i*4+1], src[i*4]
+		}
+		return
+	case *image.YCbCr:
+		for i := 0; i < e.width; i++ {
+			r, g, b, _ := m.YCbCrAt(x0+i, y).RGBA()
+			putBGR(rowBuf[i*3:], r, g, b)
+		}
+		return
+	case *image.Gray:
+		src := m.Pix[m.PixOffset(x0, y):]
+		for i := 0; i < e.width; i++ {
+			rowBuf[i*3], rowBuf[i*3+1], rowBuf[i*3+2] = src[i], src[i], src[i]
+		}
+		return
+	case *image.Paletted:
+		src := m.Pix[m.PixOffset(x0, y):]
+		for i := 0; i < e.width; i++ {
+			copy(rowBuf[i*3:i*3+3], e.palBGRA[src[i]][:])
+		}
+		return
+	}
+
+	for i := 0; i < e.width; i++ {
+		r, g, b, _ := e.m.At(x0+i, y).RGBA()
+		putBGR(rowBuf[i*3:], r, g, b)
+	}
+}
+
+// Read a row from the source image, and store it in rowBuf in 32-bit BMP format,
+// without an alpha channel.
+func generateRow_32RGB(e *encoder, j int, rowBuf []byte) {
+	generateRow_24(e, j, rowBuf[:3*e.width])
+	// Spread out the pixels, working backward so as not to overwrite any.
+	for i := e.width - 1; i >= 0; i-- {
+		copy(rowBuf[i*4:i*4+3], rowBuf[i*3:i*3+3])
+		rowBuf[i*4+3] = 0
 	}
 }
 
 // Read a row from the source image, and store it in rowBuf in 32-bit BMP format.
 func generateRow_32(e *encoder, j int, rowBuf []byte) {
-	var s [4]uint32
-	for i := 0; i < e.width; i++ {
-		srcclr := e.m.At(e.srcBounds.Min.X+i, e.srcBounds.Min.Y+j)
-		s[2], s[1], s[0], s[3] = srcclr.RGBA()
-		for k := 0; k < 4; k++ {
-			if s[3] == 0 {
-				rowBuf[i*4+k] = 0
-			} else if k == 3 || s[3] == 0xffff {
-				rowBuf[i*4+k] = uint8(s[k] >> 8)
+	x0 := e.srcBounds.Min.X
+	y := e.srcBounds.Min.Y + j
+
+	switch m := e.m.(type) {
+	case *image.NRGBA:
+		src := m.Pix[m.PixOffset(x0, y):]
+		for i := 0; i < e.width; i++ {
+			s := src[i*4 : i*4+4]
+			if s[3] == 0xff {
+				rowBuf[i*4], rowBuf[i*4+1], rowBuf[i*4+2], rowBuf[i*4+3] = s[2], s[1], s[0], 0xff
 			} else {
-				// Convert to unassociated alpha
-				rowBuf[i*4+k] = uint8(0.5 + 255.0*(float64(s[k])/float64(s[3])))
+				a := uint32(s[3]) * 0x101
+				putBGRA(rowBuf[i*4:], premultiply(s[0], a), premultiply(s[1], a),
+					premultiply(s[2], a), a)
 			}
 		}
+		return
+	case *image.RGBA:
+		src := m.Pix[m.PixOffset(x0, y):]
+		for i := 0; i < e.width; i++ {
+			s := src[i*4 : i*4+4]
+			putBGRA(rowBuf[i*4:], uint32(s[0])*0x101, uint32(s[1])*0x101,
+				uint32(s[2])*0x101, uint32(s[3])*0x101)
+		}
+		return
+	case *image.Paletted:
+		src := m.Pix[m.PixOffset(x0, y):]
+		for i := 0; i < e.width; i++ {
+			copy(rowBuf[i*4:i*4+4], e.palBGRA[src[i]][:])
+		}
+		return
+	}
+
+	for i := 0; i < e.width; i++ {
+		r, g, b, a := e.m.At(x0+i, y).RGBA()
+		putBGRA(rowBuf[i*4:], r, g, b, a)
 	}
 }
 
@@ -218,6 +559,15 @@ func (e *encoder) writeBits() error {
 	var err error
 	var genRowFunc func(e *encoder, j int, rowBuf []byte)
 
+	if e.dstCompression == bI_RLE4 || e.dstCompression == bI_RLE8 {
+		// The image was already compressed by strategize().
+		_, err = e.w.Write(e.rleBits)
+		if err != nil {
+			return err
+		}
+		return e.rowsDone(e.height)
+	}
+
 	if e.writePaletted {
 		if e.srcIsGray {
 			genRowFunc = generateRow_GrayPal
@@ -225,6 +575,8 @@ func (e *encoder) writeBits() error {
 			switch e.dstBitCount {
 			case 1:
 				genRowFunc = generateRow_1
+			case 2:
+				genRowFunc = generateRow_2
 			case 4:
 				genRowFunc = generateRow_4
 			default:
@@ -232,25 +584,111 @@ func (e *encoder) writeBits() error {
 			}
 		}
 	} else {
-		if e.dstBitCount == 32 {
-			genRowFunc = generateRow_32
-		} else {
+		if p, ok := e.m.(*image.Paletted); ok {
+			e.makePalBGRA(p, e.writeAlpha)
+		}
+		switch e.dstBitCount {
+		case 32:
+			if e.writeAlpha {
+				genRowFunc = generateRow_32
+			} else {
+				genRowFunc = generateRow_32RGB
+			}
+		case 16:
+			e.setup16()
+			genRowFunc = generateRow_16
+		default:
 			genRowFunc = generateRow_24
 		}
 	}
 
+	workers := numWorkers(e.opts.concurrency)
+	if e.dstBitCount == 16 && (e.opts.dither == DitherFloydSteinberg ||
+		e.opts.alphaDither == DitherFloydSteinberg) {
+		// Error diffusion requires the rows to be processed in order.
+		workers = 1
+	}
+	if workers > 1 && e.width > 0 && e.height > 0 {
+		return e.writeBitsParallel(genRowFunc, workers)
+	}
+
 	rowBuf := make([]byte, e.dstStride)
 
 	for j := 0; j < e.height; j++ {
-		genRowFunc(e, e.height-j-1, rowBuf)
+		genRowFunc(e, e.rowAt(j), rowBuf)
 		_, err = e.w.Write(rowBuf)
 		if err != nil {
 			return err
 		}
+		err = e.rowsDone(j + 1)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Generates many rows at a time using multiple goroutines, then writes them.
+func (e *encoder) writeBitsParallel(genRowFunc func(e *encoder, j int, rowBuf []byte),
+	workers int) error {
+	var err error
+
+	chunkRows := rowsPerChunk(workers, e.dstStride, e.height)
+	buf := make([]byte, chunkRows*e.dstStride)
+
+	// Each worker needs its own scratch buffer, and so its own copy of the
+	// encoder.
+	encs := make([]*encoder, workers)
+	for w := range encs {
+		encs[w] = e
+		if e.rowScratch != nil {
+			ew := *e
+			ew.rowScratch = make([]byte, len(e.rowScratch))
+			encs[w] = &ew
+		}
+	}
+
+	for startRow := 0; startRow < e.height; startRow += chunkRows {
+		numRows := chunkRows
+		if startRow+numRows > e.height {
+			numRows = e.height - startRow
+		}
+
+		parallelRows(numRows, workers, func(w, k int) error {
+			genRowFunc(encs[w], e.rowAt(startRow+k), buf[k*e.dstStride:(k+1)*e.dstStride])
+			return nil
+		})
+
+		_, err = e.w.Write(buf[:numRows*e.dstStride])
+		if err != nil {
+			return err
+		}
+		err = e.rowsDone(startRow + numRows)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the source row number (counting from the top) of the jth row to be
+// written.
+func (e *encoder) rowAt(j int) int {
+	if e.opts.topDown {
+		return j
+	}
+	return e.height - j - 1
+}
+
+// Called after each row (or group of rows) is written. Reports progress, and
+// returns an error if the operation has been canceled.
+func (e *encoder) rowsDone(n int) error {
+	if e.opts.progressFn != nil {
+		e.opts.progressFn(n, e.height)
+	}
+	return e.ctx.Err()
+}
+
 // If the image can be written as a paletted image, sets e.writePaletted
 // to true, and sets related fields.
 func (e *encoder) checkPaletted() {
@@ -275,11 +713,53 @@ func (e *encoder) checkPaletted() {
 	}
 }
 
+// If the image is a paletted image with a fully transparent palette entry,
+// sets e.rleSkipTrns to true, and records the transparent entries.
+func (e *encoder) checkRLETransparency() {
+	p, ok := e.m.(*image.Paletted)
+	if !ok || len(p.Palette) < 1 || len(p.Palette) > 256 {
+		return
+	}
+	for i, c := range p.Palette {
+		_, _, _, a := c.RGBA()
+		if a == 0 {
+			e.rleTrns[i] = true
+			e.rleSkipTrns = true
+		}
+	}
+}
+
 func (e *encoder) srcIsOpaque() bool {
-	switch e.m.(type) {
+	switch m := e.m.(type) {
 	// If the image's type doesn't even support transparency, it must be opaque.
 	case *image.YCbCr, *image.Gray, *image.Gray16:
 		return true
+	case *image.Paletted:
+		// Check the palette entries that are used. (*image.Paletted).Opaque
+		// would do this, but it can't handle more than 256 entries.
+		used := make([]bool, len(m.Palette))
+		for j := 0; j < e.height; j++ {
+			row := m.Pix[m.PixOffset(e.srcBounds.Min.X, e.srcBounds.Min.Y+j):]
+			for _, v := range row[:e.width] {
+				if int(v) < len(used) {
+					used[v] = true
+				}
+			}
+		}
+		for i, c := range m.Palette {
+			_, _, _, a := c.RGBA()
+			if used[i] && a < 0xffff {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Most image types know how to answer this question efficiently.
+	if o, ok := e.m.(interface {
+		Opaque() bool
+	}); ok {
+		return o.Opaque()
 	}
 
 	for j := e.srcBounds.Min.Y; j < e.srcBounds.Max.Y; j++ {
@@ -299,17 +779,75 @@ func (e *encoder) strategize() error {
 	e.width = e.srcBounds.Dx()
 	e.height = e.srcBounds.Dy()
 
-	if e.opts.supportTrns && !e.srcIsOpaque() {
+	e.bitCount = e.opts.bitCount
+	format16 := e.opts.format16
+	switch e.bitCount {
+	case 0, 1, 2, 4, 8, 24, 32:
+		if format16 != 0 && e.bitCount != 0 {
+			return UnsupportedError(fmt.Sprintf("16-bit format with bit count %d", e.bitCount))
+		}
+	case 16:
+		if format16 == 0 {
+			format16 = RGB555
+		}
+	default:
+		return UnsupportedError(fmt.Sprintf("bit count %d", e.bitCount))
+	}
+
+	if e.opts.rleTrns && (e.bitCount == 0 || e.bitCount == 4 || e.bitCount == 8) {
+		e.checkRLETransparency()
+	}
+
+	if e.opts.supportTrns && !e.rleSkipTrns && format16 == 0 &&
+		((e.bitCount == 0 && !e.usePaletteAlpha()) || e.bitCount == 32) && !e.srcIsOpaque() {
 		e.writeAlpha = true
-		e.headerSize = 124
-	} else {
-		e.headerSize = 40
+		e.dstCompression = bI_BITFIELDS
+		e.dstMasks = [4]uint32{0x00ff0000, 0x0000ff00, 0x000000ff, 0xff000000}
 	}
 
-	e.checkPaletted()
-	if e.writePaletted {
+	if format16 != 0 {
+		masks, ok := format16Masks[format16]
+		if !ok {
+			return UnsupportedError(fmt.Sprintf("16-bit format %d", format16))
+		}
+		e.dstBitCount = 16
+		e.dstMasks = masks
+		if masks[3] != 0 {
+			e.writeAlpha = true
+		}
+		if masks != format16Masks[RGB555] {
+			e.dstCompression = bI_BITFIELDS
+		}
+	} else if e.bitCount <= 8 {
+		e.checkPaletted()
+		if e.bitCount != 0 {
+			err := e.fitPalette(e.bitCount)
+			if err != nil {
+				return err
+			}
+		} else if !e.writePaletted && !e.writeAlpha {
+			if e.opts.quantize {
+				err := e.fitPalette(8)
+				if err != nil {
+					return err
+				}
+			} else if e.opts.autoPalette {
+				e.makeExactPalette(256)
+			}
+		}
+		e.optimizePalette()
+		e.checkPaletteAlpha()
+	}
+
+	if e.dstBitCount == 16 {
+		// Already decided
+	} else if e.bitCount != 0 {
+		e.dstBitCount = e.bitCount
+	} else if e.writePaletted {
 		if e.nColors <= 2 {
 			e.dstBitCount = 1
+		} else if e.nColors <= 4 && e.opts.support2Bit && e.opts.headerType != HeaderCore {
+			e.dstBitCount = 2
 		} else if e.nColors <= 16 {
 			e.dstBitCount = 4
 		} else {
@@ -323,9 +861,169 @@ func (e *encoder) strategize() error {
 		}
 	}
 	e.dstStride = ((e.width*e.dstBitCount + 31) / 32) * 4
-	e.dstBitsOffset = 14 + e.headerSize + 4*e.nColors
 	e.dstBitsSize = e.height * e.dstStride
-	e.dstFileSize = e.dstBitsOffset + e.dstBitsSize
+
+	if e.writePaletted && (e.opts.rle || e.opts.smallest || e.rleSkipTrns) {
+		err := e.chooseCompression()
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.opts.topDown && (e.dstCompression == bI_RLE4 || e.dstCompression == bI_RLE8) {
+		return UnsupportedError("top-down compressed image")
+	}
+
+	err := e.setupColorSpace()
+	if err != nil {
+		return err
+	}
+
+	err = e.setHeaderType()
+	if err != nil {
+		return err
+	}
+
+	e.dstBitsOffset = 14 + e.headerSize + e.bitFieldsSegmentSize + e.palEntrySize*e.palNumEntries
+	e.dstFileSize = e.dstBitsOffset + e.dstBitsSize + len(e.profile)
+	return nil
+}
+
+// Decide which version of the info header to write, and how to store the
+// bitfields masks (if any).
+func (e *encoder) setHeaderType() error {
+	if e.forIcon {
+		// Icons always use a BITMAPINFOHEADER, and store any alpha channel
+		// in the 4th byte of each 32-bit BI_RGB pixel.
+		e.headerSize = 40
+		e.palNumEntries = e.nColors
+		e.palEntrySize = 4
+		e.dstCompression = bI_RGB
+		return nil
+	}
+
+	h := e.opts.headerType
+	if h == 0 {
+		if e.profile != nil ||
+			(e.writeAlpha && !(e.dstBitCount == 16 && e.opts.alphaBitFields)) {
+			h = HeaderV5
+		} else if e.csType == lCS_CALIBRATED_RGB {
+			h = HeaderV4
+		} else {
+			h = HeaderInfo
+		}
+	}
+
+	e.palNumEntries = e.nColors
+	e.palEntrySize = 4
+
+	switch h {
+	case HeaderCore:
+		err := e.checkCoreHeader()
+		if err != nil {
+			return err
+		}
+		if e.palAlpha {
+			return UnsupportedError("palette alpha with a BITMAPCOREHEADER")
+		}
+		// The palette always has 2^bitCount 3-byte entries.
+		if e.writePaletted {
+			e.palNumEntries = 1 << uint(e.dstBitCount)
+		}
+		e.palEntrySize = 3
+	case HeaderInfo, HeaderV3, HeaderV4, HeaderV5:
+	case HeaderV2:
+		if e.writeAlpha {
+			return UnsupportedError("transparency with a BITMAPV2INFOHEADER")
+		}
+	default:
+		return UnsupportedError(fmt.Sprintf("writing %v", h))
+	}
+	e.headerSize = int(h)
+
+	if e.dstCompression == bI_BITFIELDS && e.headerSize == 40 {
+		// The masks go in a separate segment.
+		if e.writeAlpha {
+			e.dstCompression = bI_ALPHABITFIELDS
+			e.bitFieldsSegmentSize = 16
+		} else {
+			e.bitFieldsSegmentSize = 12
+		}
+	}
+	return nil
+}
+
+// Returns an error if the image can't be written with a BITMAPCOREHEADER.
+func (e *encoder) checkCoreHeader() error {
+	if e.width > 65535 || e.height > 65535 {
+		return UnsupportedError("dimensions too large for a BITMAPCOREHEADER")
+	}
+	switch e.dstBitCount {
+	case 1, 4, 8, 24:
+	default:
+		return UnsupportedError(fmt.Sprintf("bit count %d with a BITMAPCOREHEADER", e.dstBitCount))
+	}
+	if e.dstCompression != bI_RGB {
+		return UnsupportedError("compression with a BITMAPCOREHEADER")
+	}
+	if e.opts.topDown {
+		return UnsupportedError("top-down image with a BITMAPCOREHEADER")
+	}
+	return nil
+}
+
+// Decide whether to compress a paletted image. If so, compresses it, and sets
+// the related fields.
+func (e *encoder) chooseCompression() error {
+	var candidates []uint32
+
+	if (e.opts.headerType == HeaderCore || e.opts.topDown) && (e.opts.smallest || !e.opts.rle) &&
+		!e.rleSkipTrns {
+		// Compression isn't possible, so "smallest" means uncompressed.
+		return nil
+	}
+
+	// If a bit count was requested, only consider compression types that
+	// use it.
+	allowRLE4 := e.bitCount == 0 || e.bitCount == 4
+	allowRLE8 := e.bitCount == 0 || e.bitCount == 8
+
+	if e.opts.smallest {
+		if e.nColors <= 16 && allowRLE4 {
+			candidates = append(candidates, bI_RLE4)
+		}
+		if allowRLE8 {
+			candidates = append(candidates, bI_RLE8)
+		}
+	} else if e.dstBitCount == 8 {
+		candidates = append(candidates, bI_RLE8)
+	} else if allowRLE4 {
+		candidates = append(candidates, bI_RLE4)
+	}
+
+	for _, compression := range candidates {
+		bits, err := e.compressRLE(compression)
+		if err != nil {
+			return err
+		}
+		// In "smallest" mode, prefer an uncompressed image if it's the same
+		// size, because it's more portable. But if we're skipping transparent
+		// pixels, an uncompressed image isn't an option.
+		if e.opts.smallest && len(bits) >= e.dstBitsSize &&
+			(e.dstCompression != bI_RGB || !e.rleSkipTrns) {
+			continue
+		}
+
+		e.dstCompression = compression
+		e.rleBits = bits
+		e.dstBitsSize = len(bits)
+		if compression == bI_RLE4 {
+			e.dstBitCount = 4
+		} else {
+			e.dstBitCount = 8
+		}
+	}
+	e.dstStride = ((e.width*e.dstBitCount + 31) / 32) * 4
 	return nil
 }
 
@@ -333,9 +1031,16 @@ func (e *encoder) strategize() error {
 // recorded in opts.
 // opts may be nil, in which case it behaves the same as Encode.
 func EncodeWithOptions(w io.Writer, m image.Image, opts *EncoderOptions) error {
+	return EncodeContext(context.Background(), w, m, opts)
+}
+
+// EncodeContext is like EncodeWithOptions, but stops writing and returns
+// ctx.Err() if ctx is canceled before the image has been completely written.
+func EncodeContext(ctx context.Context, w io.Writer, m image.Image, opts *EncoderOptions) error {
 	var err error
 
 	e := new(encoder)
+	e.ctx = ctx
 	e.w = w
 	e.m = m
 	if opts != nil {
@@ -364,6 +1069,11 @@ func EncodeWithOptions(w io.Writer, m image.Image, opts *EncoderOptions) error {
 		return err
 	}
 
+	err = e.writeProfile()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
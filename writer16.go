@@ -0,0 +1,201 @@
+// ◄◄◄ gobmp/writer16.go ►►►
+// Copyright © 2012 Jason Summers
+// Use of this code is governed by an MIT-style license that can
+// be found in the readme.md file.
+//
+// 16-bit output and dithering
+//
+
+package gobmp
+
+// A Format16 is a layout for 16-bit pixels. See EncoderOptions.Set16Bit.
+type Format16 int
+
+// Supported Format16 values.
+const (
+	RGB555   Format16 = 1 + iota // 5 bits each for red, green, and blue
+	RGB565                       // 5 bits for red and blue, 6 for green
+	ARGB1555                     // 1 bit for alpha, 5 bits for each color
+	ARGB4444                     // 4 bits each for alpha, red, green, and blue
+)
+
+// The red, green, blue, and alpha masks for each Format16.
+var format16Masks = map[Format16][4]uint32{
+	RGB555:   {0x7c00, 0x03e0, 0x001f, 0},
+	RGB565:   {0xf800, 0x07e0, 0x001f, 0},
+	ARGB1555: {0x7c00, 0x03e0, 0x001f, 0x8000},
+	ARGB4444: {0x0f00, 0x00f0, 0x000f, 0xf000},
+}
+
+// A DitherMode selects a method of reducing the number of colors in an image.
+type DitherMode int
+
+// Supported DitherMode values.
+const (
+	DitherNone           DitherMode = iota // Use the nearest color
+	DitherOrdered                          // Ordered (4×4 Bayer matrix) dithering
+	DitherFloydSteinberg                   // Floyd–Steinberg error diffusion
+)
+
+// Set16Bit causes the image to be written with 16 bits per pixel, in the
+// given format. RGB555 images are written as BI_RGB images; other formats
+// use BI_BITFIELDS. A format of 0 (the default) disables 16-bit output.
+//
+// RGB555 and RGB565 discard any transparency. ARGB1555 and ARGB4444 always
+// include an alpha channel, and by default use a BITMAPV5HEADER.
+func (opts *EncoderOptions) Set16Bit(f Format16) {
+	opts.format16 = f
+}
+
+// SetAlphaBitFields causes 16-bit images that have an alpha channel to be
+// written with a 40-byte BITMAPINFOHEADER and BI_ALPHABITFIELDS compression,
+// instead of a BITMAPV5HEADER. This makes the file smaller, but fewer
+// applications can read it. It has no effect if SetHeaderType is used.
+func (opts *EncoderOptions) SetAlphaBitFields(b bool) {
+	opts.alphaBitFields = b
+}
+
+// SetAlphaThreshold sets the smallest alpha value that is considered opaque,
+// when writing a 1-bit alpha channel without dithering. The default is 128.
+func (opts *EncoderOptions) SetAlphaThreshold(t uint8) {
+	opts.alphaThreshSet = true
+	opts.alphaThresh = t
+}
+
+// SetAlphaDither sets the method used to reduce the precision of the alpha
+// channel, when writing 16-bit images with alpha. The default is DitherNone.
+func (opts *EncoderOptions) SetAlphaDither(d DitherMode) {
+	opts.alphaDither = d
+}
+
+// SetDither sets the method used to reduce the number of colors, when an
+// image can't be written without doing so. The default is DitherNone.
+func (opts *EncoderOptions) SetDither(d DitherMode) {
+	opts.dither = d
+}
+
+// The 4×4 Bayer matrix used for ordered dithering.
+var bayer4 = [4][4]int32{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+type chan16Info struct {
+	shift  uint
+	maxVal int32 // 0 if the channel is not present
+}
+
+// Prepare to write a 16-bit image using the masks in e.dstMasks.
+func (e *encoder) setup16() {
+	for k := 0; k < 4; k++ {
+		mask := e.dstMasks[k]
+		e.chan16[k] = chan16Info{}
+		if mask == 0 {
+			continue
+		}
+		for mask&0x1 == 0 {
+			e.chan16[k].shift++
+			mask >>= 1
+		}
+		e.chan16[k].maxVal = int32(mask)
+	}
+
+	e.alphaThresh = 128
+	if e.opts.alphaThreshSet {
+		e.alphaThresh = e.opts.alphaThresh
+	}
+
+	for k := 0; k < 4; k++ {
+		if e.ditherMode(k) == DitherFloydSteinberg {
+			e.fsErrCur[k] = make([]int32, e.width+2)
+			e.fsErrNext[k] = make([]int32, e.width+2)
+		}
+	}
+
+	e.rowScratch = make([]byte, 4*e.width)
+}
+
+// Returns the dither mode to use for channel k.
+func (e *encoder) ditherMode(k int) DitherMode {
+	if k == 3 {
+		return e.opts.alphaDither
+	}
+	return e.opts.dither
+}
+
+// Reduce the 8-bit sample s of channel k to the range [0..maxVal], for the
+// pixel in column i of row j.
+func (e *encoder) reduceSample(k int, s uint8, i, j int) int32 {
+	maxVal := e.chan16[k].maxVal
+
+	switch e.ditherMode(k) {
+	case DitherOrdered:
+		t := bayer4[j%4][i%4]
+		return (int32(s)*maxVal*32 + (2*t+1)*255) / (255 * 32)
+	case DitherFloydSteinberg:
+		// Errors are stored in units of 1/(255*16) of a level.
+		v := int32(s)*maxVal*16 + e.fsErrCur[k][i+1]/16
+		q := (v + 255*8) / (255 * 16)
+		if v < 0 {
+			q = 0
+		} else if q > maxVal {
+			q = maxVal
+		}
+		qerr := v - q*255*16
+		e.fsErrCur[k][i+2] += qerr * 7
+		e.fsErrNext[k][i] += qerr * 3
+		e.fsErrNext[k][i+1] += qerr * 5
+		e.fsErrNext[k][i+2] += qerr * 1
+		return q
+	}
+	if k == 3 && maxVal == 1 {
+		if s >= e.alphaThresh {
+			return 1
+		}
+		return 0
+	}
+	return (int32(s)*maxVal + 127) / 255
+}
+
+// Read a row from the source image, and store it in rowBuf in 16-bit BMP
+// format.
+func generateRow_16(e *encoder, j int, rowBuf []byte) {
+	var src []byte
+	var srcBPP int
+	if e.writeAlpha {
+		srcBPP = 4
+		src = e.rowScratch[:srcBPP*e.width]
+		generateRow_32(e, j, src)
+	} else {
+		srcBPP = 3
+		src = e.rowScratch[:srcBPP*e.width]
+		generateRow_24(e, j, src)
+	}
+
+	for i := 0; i < e.width; i++ {
+		var v int32
+		for k := 0; k < 4; k++ {
+			if e.chan16[k].maxVal == 0 {
+				continue
+			}
+			// src is in B,G,R,A order
+			sk := 2 - k
+			if k == 3 {
+				sk = 3
+			}
+			v |= e.reduceSample(k, src[i*srcBPP+sk], i, j) << e.chan16[k].shift
+		}
+		setWORD(rowBuf[i*2:i*2+2], uint16(v))
+	}
+
+	for k := 0; k < 4; k++ {
+		if e.fsErrCur[k] != nil {
+			e.fsErrCur[k], e.fsErrNext[k] = e.fsErrNext[k], e.fsErrCur[k]
+			for i := range e.fsErrNext[k] {
+				e.fsErrNext[k][i] = 0
+			}
+		}
+	}
+}